@@ -0,0 +1,445 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// calendarSpec is a parsed systemd calendar expression, see systemd.time(7).
+// A nil field matches any value.
+type calendarSpec struct {
+	weekdays []int // 0 = Sunday
+	years    []int
+	months   []int
+	days     []int
+	hours    []int
+	minutes  []int
+	seconds  []int
+	// location is the time zone the expression ends with, if any.
+	location *time.Location
+}
+
+var calendarShorthands = map[string]string{
+	"minutely":     "*-*-* *:*:00",
+	"hourly":       "*-*-* *:00:00",
+	"daily":        "*-*-* 00:00:00",
+	"monthly":      "*-*-01 00:00:00",
+	"weekly":       "Mon *-*-* 00:00:00",
+	"yearly":       "*-01-01 00:00:00",
+	"annually":     "*-01-01 00:00:00",
+	"quarterly":    "*-01,04,07,10-01 00:00:00",
+	"semiannually": "*-01,07-01 00:00:00",
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "sunday": 0,
+	"mon": 1, "monday": 1,
+	"tue": 2, "tuesday": 2,
+	"wed": 3, "wednesday": 3,
+	"thu": 4, "thursday": 4,
+	"fri": 5, "friday": 5,
+	"sat": 6, "saturday": 6,
+}
+
+func parseCalendar(expr string) (*calendarSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty calendar expression")
+	}
+
+	// a trailing time zone, such as UTC or Europe/Berlin
+	var location *time.Location
+	if last := fields[len(fields)-1]; len(fields) > 1 && unicode.IsLetter(rune(last[0])) && !strings.Contains(last, ":") {
+		if _, err := parseWeekdays(last); err != nil {
+			loc, err := time.LoadLocation(last)
+			if err != nil {
+				return nil, fmt.Errorf("invalid calendar expression %q: unknown time zone %q", expr, last)
+			}
+			location = loc
+			fields = fields[:len(fields)-1]
+		}
+	}
+	if full, ok := calendarShorthands[strings.ToLower(strings.Join(fields, " "))]; ok {
+		fields = strings.Fields(full)
+	}
+
+	spec := &calendarSpec{hours: []int{0}, minutes: []int{0}, seconds: []int{0}, location: location}
+	var err error
+
+	if first := fields[0]; unicode.IsLetter(rune(first[0])) && !strings.ContainsAny(first, "-:") {
+		if spec.weekdays, err = parseWeekdays(first); err != nil {
+			return nil, fmt.Errorf("invalid calendar expression %q: %v", expr, err)
+		}
+		fields = fields[1:]
+	}
+
+	if len(fields) > 0 && strings.Contains(fields[0], "-") && !strings.Contains(fields[0], ":") {
+		parts := strings.Split(fields[0], "-")
+		if len(parts) == 2 {
+			parts = append([]string{"*"}, parts...)
+		}
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid calendar expression %q: malformed date %q", expr, fields[0])
+		}
+		if spec.years, err = parseCalendarComponent(parts[0], 1970, 2199); err != nil {
+			return nil, fmt.Errorf("invalid calendar expression %q: year: %v", expr, err)
+		}
+		if spec.months, err = parseCalendarComponent(parts[1], 1, 12); err != nil {
+			return nil, fmt.Errorf("invalid calendar expression %q: month: %v", expr, err)
+		}
+		if spec.days, err = parseCalendarComponent(parts[2], 1, 31); err != nil {
+			return nil, fmt.Errorf("invalid calendar expression %q: day: %v", expr, err)
+		}
+		fields = fields[1:]
+	}
+
+	if len(fields) > 0 && strings.Contains(fields[0], ":") {
+		parts := strings.Split(fields[0], ":")
+		if len(parts) == 2 {
+			parts = append(parts, "00")
+		}
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid calendar expression %q: malformed time %q", expr, fields[0])
+		}
+		if spec.hours, err = parseCalendarComponent(parts[0], 0, 23); err != nil {
+			return nil, fmt.Errorf("invalid calendar expression %q: hour: %v", expr, err)
+		}
+		if spec.minutes, err = parseCalendarComponent(parts[1], 0, 59); err != nil {
+			return nil, fmt.Errorf("invalid calendar expression %q: minute: %v", expr, err)
+		}
+		if spec.seconds, err = parseCalendarComponent(parts[2], 0, 59); err != nil {
+			return nil, fmt.Errorf("invalid calendar expression %q: second: %v", expr, err)
+		}
+		fields = fields[1:]
+	}
+
+	if len(fields) > 0 {
+		return nil, fmt.Errorf("invalid calendar expression %q: unexpected %q", expr, strings.Join(fields, " "))
+	}
+	return spec, nil
+}
+
+func parseWeekdays(value string) ([]int, error) {
+	var result []int
+	for _, item := range strings.Split(value, ",") {
+		from, to, isRange := strings.Cut(item, "..")
+		start, ok := weekdayNames[strings.ToLower(from)]
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday %q", from)
+		}
+		end := start
+		if isRange {
+			if end, ok = weekdayNames[strings.ToLower(to)]; !ok {
+				return nil, fmt.Errorf("unknown weekday %q", to)
+			}
+		}
+		for d := start; ; d = (d + 1) % 7 {
+			result = append(result, d)
+			if d == end {
+				break
+			}
+		}
+	}
+	return uniqueSorted(result), nil
+}
+
+// parseCalendarComponent parses a single date or time component such as
+// "*", "1,15", "1..5" or "0/15" into the list of values it matches.
+func parseCalendarComponent(value string, min, max int) ([]int, error) {
+	if value == "*" {
+		return nil, nil
+	}
+	var result []int
+	for _, item := range strings.Split(value, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			s, err := strconv.Atoi(stepPart)
+			if err != nil || s <= 0 {
+				return nil, fmt.Errorf("invalid repetition %q", stepPart)
+			}
+			step = s
+		}
+
+		var start, end int
+		if rangePart == "*" {
+			start, end = min, max
+		} else {
+			from, to, isRange := strings.Cut(rangePart, "..")
+			s, err := strconv.Atoi(from)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q", from)
+			}
+			start, end = s, s
+			if isRange {
+				if end, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("invalid value %q", to)
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("value %q out of range %d..%d", rangePart, min, max)
+		}
+		for v := start; v <= end; v += step {
+			result = append(result, v)
+		}
+	}
+	return uniqueSorted(result), nil
+}
+
+func uniqueSorted(values []int) []int {
+	sort.Ints(values)
+	result := values[:0]
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+var timeSpanUnits = map[string]time.Duration{
+	"us": time.Microsecond, "usec": time.Microsecond,
+	"ms": time.Millisecond, "msec": time.Millisecond,
+	"s": time.Second, "sec": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hr": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+}
+
+// parseTimeSpan parses a systemd time span such as "30s", "5min" or
+// "1h 30min". A bare number is interpreted as seconds.
+func parseTimeSpan(value string) (time.Duration, error) {
+	s := strings.ReplaceAll(strings.TrimSpace(value), " ", "")
+	if s == "" {
+		return 0, fmt.Errorf("empty time span")
+	}
+	var total time.Duration
+	for s != "" {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid time span %q", value)
+		}
+		n, _ := strconv.Atoi(s[:i])
+		s = s[i:]
+		j := 0
+		for j < len(s) && (s[j] < '0' || s[j] > '9') {
+			j++
+		}
+		unit := time.Second
+		if j > 0 {
+			u, ok := timeSpanUnits[s[:j]]
+			if !ok {
+				return 0, fmt.Errorf("invalid time span %q: unknown unit %q", value, s[:j])
+			}
+			unit = u
+		}
+		s = s[j:]
+		total += time.Duration(n) * unit
+	}
+	return total, nil
+}
+
+// jobSchedule is anything that can tell when a job should run next.
+type jobSchedule interface {
+	Next(after time.Time) time.Time
+}
+
+// intervalSchedule runs a job every fixed duration, written as "@every 6h".
+type intervalSchedule struct {
+	every time.Duration
+}
+
+func (s intervalSchedule) Next(after time.Time) time.Time {
+	return after.Add(s.every)
+}
+
+var cronMacros = map[string]string{
+	"@hourly":   "hourly",
+	"@daily":    "daily",
+	"@midnight": "daily",
+	"@weekly":   "weekly",
+	"@monthly":  "monthly",
+	"@yearly":   "yearly",
+	"@annually": "yearly",
+}
+
+// parseSchedule accepts a systemd calendar expression, a five field cron
+// expression or an "@every <time span>" interval.
+func parseSchedule(expr string) (jobSchedule, error) {
+	trimmed := strings.TrimSpace(expr)
+	if rest, ok := strings.CutPrefix(trimmed, "@every"); ok {
+		every, err := parseTimeSpan(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval %q: %v", expr, err)
+		}
+		if every <= 0 {
+			return nil, fmt.Errorf("invalid interval %q: must be positive", expr)
+		}
+		return intervalSchedule{every: every}, nil
+	}
+	if calendar, ok := cronMacros[trimmed]; ok {
+		return parseCalendar(calendar)
+	}
+	if len(strings.Fields(trimmed)) == 5 {
+		return parseCron(trimmed)
+	}
+	return parseCalendar(trimmed)
+}
+
+// parseCron converts a cron expression ("minute hour day month weekday")
+// into a calendarSpec.
+func parseCron(expr string) (*calendarSpec, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields", expr)
+	}
+	spec := &calendarSpec{seconds: []int{0}}
+	var err error
+	if spec.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: minute: %v", expr, err)
+	}
+	if spec.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: hour: %v", expr, err)
+	}
+	if spec.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: day of month: %v", expr, err)
+	}
+	if spec.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: month: %v", expr, err)
+	}
+	weekdays := fields[4]
+	for name, n := range weekdayNames {
+		if len(name) == 3 {
+			weekdays = strings.ReplaceAll(strings.ToLower(weekdays), name, strconv.Itoa(n))
+		}
+	}
+	if spec.weekdays, err = parseCronField(weekdays, 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: day of week: %v", expr, err)
+	}
+	for i, d := range spec.weekdays {
+		if d == 7 {
+			spec.weekdays[i] = 0
+		}
+	}
+	if spec.weekdays != nil {
+		spec.weekdays = uniqueSorted(spec.weekdays)
+	}
+	// cron runs a job when either day field matches, systemd when both do.
+	if spec.days != nil && spec.weekdays != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: day of month and day of week cannot both be restricted", expr)
+	}
+	return spec, nil
+}
+
+func parseCronField(value string, min, max int) ([]int, error) {
+	return parseCalendarComponent(strings.ReplaceAll(value, "-", ".."), min, max)
+}
+
+func matchesCalendar(values []int, v int) bool {
+	if values == nil {
+		return true
+	}
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the first time after the given one that matches the
+// expression, or the zero time if there is none before the year 2200. The
+// expression is evaluated in its time zone, or else in that of after.
+func (c *calendarSpec) Next(after time.Time) time.Time {
+	loc := after.Location()
+	if c.location != nil {
+		loc = c.location
+	}
+	t := after.In(loc).Truncate(time.Second).Add(time.Second)
+	for t.Year() < 2200 {
+		y, m, d := t.Date()
+		switch {
+		case !matchesCalendar(c.years, y):
+			t = time.Date(y+1, 1, 1, 0, 0, 0, 0, loc)
+		case !matchesCalendar(c.months, int(m)):
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !matchesCalendar(c.days, d) || !matchesCalendar(c.weekdays, int(t.Weekday())):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case !matchesCalendar(c.hours, t.Hour()):
+			t = forward(t, t.Truncate(time.Minute).Add(time.Duration(60-t.Minute())*time.Minute))
+		case !matchesCalendar(c.minutes, t.Minute()):
+			t = forward(t, t.Truncate(time.Minute).Add(time.Minute))
+		case !matchesCalendar(c.seconds, t.Second()):
+			t = t.Add(time.Second)
+		default:
+			return t.In(after.Location())
+		}
+	}
+	return time.Time{}
+}
+
+// forward returns next, unless a DST change turned the clock back between t
+// and next. The repeated wall clock times are skipped then, so a time that
+// occurs twice only matches once.
+func forward(t, next time.Time) time.Time {
+	if next.Day() == t.Day() && next.Hour()*60+next.Minute() < t.Hour()*60+t.Minute() {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+	}
+	return next
+}
+
+// String renders the expression in the normalized systemd form accepted by
+// OnCalendar=.
+func (c *calendarSpec) String() string {
+	join := func(values []int, width int) string {
+		if values == nil {
+			return "*"
+		}
+		parts := make([]string, len(values))
+		for i, v := range values {
+			parts[i] = fmt.Sprintf("%0*d", width, v)
+		}
+		return strings.Join(parts, ",")
+	}
+	result := fmt.Sprintf("%s-%s-%s %s:%s:%s",
+		join(c.years, 4), join(c.months, 2), join(c.days, 2),
+		join(c.hours, 2), join(c.minutes, 2), join(c.seconds, 2))
+	if c.weekdays != nil {
+		names := []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+		days := make([]string, len(c.weekdays))
+		for i, d := range c.weekdays {
+			days[i] = names[d]
+		}
+		result = strings.Join(days, ",") + " " + result
+	}
+	if c.location != nil {
+		result += " " + c.location.String()
+	}
+	return result
+}
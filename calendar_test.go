@@ -0,0 +1,334 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCalendar(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"daily", "*-*-* 00:00:00"},
+		{"Weekly", "Mon *-*-* 00:00:00"},
+		{"quarterly", "*-01,04,07,10-01 00:00:00"},
+		{"Fri..Mon 04:30", "Sun,Mon,Fri,Sat *-*-* 04:30:00"},
+		{"Sat..Sun *-*-* 12:00", "Sun,Sat *-*-* 12:00:00"},
+		{"Mon,Wed,Mon 08:00", "Mon,Wed *-*-* 08:00:00"},
+		{"*-*-01 02:00", "*-*-01 02:00:00"},
+		{"12-24 18:00", "*-12-24 18:00:00"},
+		{"2026-12-31 23:59:59", "2026-12-31 23:59:59"},
+		{"*:0/15", "*-*-* *:00,15,30,45:00"},
+		{"*-*-1..3,10 1/8:00", "*-*-01,02,03,10 01,09,17:00:00"},
+	}
+	for _, tt := range tests {
+		spec, err := parseCalendar(tt.expr)
+		if err != nil {
+			t.Errorf("parseCalendar(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := spec.String(); got != tt.want {
+			t.Errorf("parseCalendar(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{
+		"",
+		"Funday 00:00",
+		"Mon..Funday",
+		"*-13-01",
+		"*-*-32",
+		"*-*-5..1",
+		"25:00",
+		"*:0/0",
+		"1-2-3-4",
+		"daily extra",
+	} {
+		if _, err := parseCalendar(expr); err == nil {
+			t.Errorf("parseCalendar(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"30 2 * * *", "*-*-* 02:30:00"},
+		{"*/15 * * * *", "*-*-* *:00,15,30,45:00"},
+		{"0 4 * * mon-fri", "Mon,Tue,Wed,Thu,Fri *-*-* 04:00:00"},
+		{"0 4 * * 0,7", "Sun *-*-* 04:00:00"},
+		{"0 4 * * Sat,sun", "Sun,Sat *-*-* 04:00:00"},
+		{"0 0 1 1,7 *", "*-01,07-01 00:00:00"},
+		{"5 1-3 */10 * *", "*-*-01,11,21,31 01,02,03:05:00"},
+	}
+	for _, tt := range tests {
+		spec, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := spec.String(); got != tt.want {
+			t.Errorf("parseCron(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{
+		"0 4 * *",
+		"0 4 * * * *",
+		"60 * * * *",
+		"0 24 * * *",
+		"0 0 0 * *",
+		"0 0 * 13 *",
+		"0 0 * * 8",
+		"0 4 * * fri-mon",
+		"0 4 1 * 1",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronExpression(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"daily", "0 0 * * *"},
+		{"@daily", "0 0 * * *"},
+		{"weekly", "0 0 * * 1"},
+		{"Fri..Mon 04:30", "30 4 * * 0,1,5,6"},
+		{"*-*-01 02:00", "0 2 1 * *"},
+		{"*:0/15", "0,15,30,45 * * * *"},
+		{"30 2 * * *", "30 2 * * *"},
+		{"@every 15m", "*/15 * * * *"},
+		{"@every 6h", "0 */6 * * *"},
+		{"@every 1d", "0 0 * * *"},
+		{"@every 2d", "0 0 */2 * *"},
+	}
+	for _, tt := range tests {
+		got, err := cronExpression(tt.expr)
+		if err != nil {
+			t.Errorf("cronExpression(%q): %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cronExpression(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+
+	for _, expr := range []string{
+		"@every 90s",
+		"@every 7m",
+		"@every 5h",
+		"@every 40d",
+		"2026-*-* 00:00",
+		"*:*:30",
+		"Mon *-*-01",
+		"not a schedule",
+	} {
+		if got, err := cronExpression(expr); err == nil {
+			t.Errorf("cronExpression(%q) = %q, want an error", expr, got)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	utc := func(value string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04:05", value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	tests := []struct {
+		expr  string
+		after string
+		want  string
+	}{
+		// strictly after, also for a matching or fractional start
+		{"daily", "2026-10-18 00:00:00", "2026-10-19 00:00:00"},
+		{"daily", "2026-10-18 23:59:59", "2026-10-19 00:00:00"},
+		{"*:0/15", "2026-10-18 10:07:00", "2026-10-18 10:15:00"},
+		// month and year rollover
+		{"monthly", "2026-01-31 10:00:00", "2026-02-01 00:00:00"},
+		{"daily", "2026-12-31 12:00:00", "2027-01-01 00:00:00"},
+		{"*-*-* 23:30", "2026-12-31 23:45:00", "2027-01-01 23:30:00"},
+		{"yearly", "2026-06-01 00:00:00", "2027-01-01 00:00:00"},
+		{"*-*-31 00:00", "2026-04-01 00:00:00", "2026-05-31 00:00:00"},
+		{"*-*-30 00:00", "2026-02-01 00:00:00", "2026-03-30 00:00:00"},
+		{"*-02-29 00:00", "2026-03-01 00:00:00", "2028-02-29 00:00:00"},
+		// weekdays, 2026-10-14 is a Wednesday
+		{"weekly", "2026-10-14 12:00:00", "2026-10-19 00:00:00"},
+		{"Fri..Mon 04:30", "2026-10-14 12:00:00", "2026-10-16 04:30:00"},
+		{"Fri..Mon 04:30", "2026-10-17 05:00:00", "2026-10-18 04:30:00"},
+		{"Fri..Mon 04:30", "2026-10-18 05:00:00", "2026-10-19 04:30:00"},
+		{"Fri..Mon 04:30", "2026-10-19 05:00:00", "2026-10-23 04:30:00"},
+		{"Fri..Mon 04:30", "2026-12-28 05:00:00", "2027-01-01 04:30:00"},
+		{"0 4 * * mon-fri", "2026-10-16 05:00:00", "2026-10-19 04:00:00"},
+		{"Fri *-*-13", "2026-01-01 00:00:00", "2026-02-13 00:00:00"},
+		{"2025-*-* 00:00", "2026-01-01 00:00:00", ""},
+	}
+	for _, tt := range tests {
+		schedule, err := parseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tt.expr, err)
+			continue
+		}
+		got := schedule.Next(utc(tt.after))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s = %s, want none", tt.expr, tt.after, got)
+			}
+			continue
+		}
+		if !got.Equal(utc(tt.want)) {
+			t.Errorf("%q after %s = %s, want %s", tt.expr, tt.after, got, tt.want)
+		}
+	}
+
+	interval, err := parseSchedule("@every 6h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := interval.Next(utc("2026-12-31 20:00:00")), utc("2027-01-01 02:00:00"); !got.Equal(want) {
+		t.Errorf("@every 6h = %s, want %s", got, want)
+	}
+}
+
+func TestNextDST(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+	// clocks go from 02:00 CET to 03:00 CEST on 2026-03-29 and from
+	// 03:00 CEST back to 02:00 CET on 2026-10-25
+	tests := []struct {
+		expr  string
+		after time.Time
+		want  string
+	}{
+		{"daily", time.Date(2026, 3, 28, 12, 0, 0, 0, loc), "2026-03-29 00:00:00 CET"},
+		{"daily", time.Date(2026, 3, 29, 12, 0, 0, 0, loc), "2026-03-30 00:00:00 CEST"},
+		{"*-*-* 03:00", time.Date(2026, 3, 29, 0, 0, 0, 0, loc), "2026-03-29 03:00:00 CEST"},
+		{"hourly", time.Date(2026, 3, 29, 1, 30, 0, 0, loc), "2026-03-29 03:00:00 CEST"},
+		// a time skipped by the change does not run that day
+		{"*-*-* 02:30", time.Date(2026, 3, 29, 0, 0, 0, 0, loc), "2026-03-30 02:30:00 CEST"},
+		{"daily", time.Date(2026, 10, 24, 12, 0, 0, 0, loc), "2026-10-25 00:00:00 CEST"},
+		{"daily", time.Date(2026, 10, 25, 12, 0, 0, 0, loc), "2026-10-26 00:00:00 CET"},
+		{"*-*-* 04:00", time.Date(2026, 10, 25, 0, 0, 0, 0, loc), "2026-10-25 04:00:00 CET"},
+		// a time repeated by the change runs once
+		{"*-*-* 02:30", time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC).In(loc), "2026-10-25 02:30:00 CEST"},
+		{"*-*-* 02:30", time.Date(2026, 10, 25, 0, 30, 0, 0, time.UTC).In(loc), "2026-10-26 02:30:00 CET"},
+		{"hourly", time.Date(2026, 10, 25, 1, 30, 0, 0, loc), "2026-10-25 02:00:00 CEST"},
+		{"hourly", time.Date(2026, 10, 25, 0, 0, 0, 0, time.UTC).In(loc), "2026-10-25 03:00:00 CET"},
+		// but never before the start during the repeated hour
+		{"*-*-* 02:30", time.Date(2026, 10, 25, 1, 0, 0, 0, time.UTC).In(loc), "2026-10-25 02:30:00 CET"},
+		{"*:0/20", time.Date(2026, 10, 25, 1, 5, 0, 0, time.UTC).In(loc), "2026-10-25 02:20:00 CET"},
+	}
+	for _, tt := range tests {
+		schedule, err := parseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("parseSchedule(%q): %v", tt.expr, err)
+			continue
+		}
+		got := schedule.Next(tt.after)
+		if !got.After(tt.after) {
+			t.Errorf("%q after %s = %s, not after the start", tt.expr, tt.after, got)
+		}
+		if s := got.Format("2006-01-02 15:04:05 MST"); s != tt.want {
+			t.Errorf("%q after %s = %s, want %s", tt.expr, tt.after, s, tt.want)
+		}
+	}
+}
+
+func TestCalendarTimeZone(t *testing.T) {
+	if _, err := time.LoadLocation("Europe/Sofia"); err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	tests := []struct {
+		expr   string
+		want   string
+		after  time.Time
+		next   time.Time
+		format string
+	}{
+		{"*-*-* 03:00:00 UTC", "*-*-* 03:00:00 UTC",
+			time.Date(2026, 10, 18, 12, 0, 0, 0, berlin), time.Date(2026, 10, 19, 3, 0, 0, 0, time.UTC), "2026-10-19 05:00:00 CEST"},
+		{"Mon 02:00 Europe/Sofia", "Mon *-*-* 02:00:00 Europe/Sofia",
+			time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC), "2026-10-18 23:00:00 UTC"},
+		{"daily UTC", "*-*-* 00:00:00 UTC",
+			time.Date(2026, 10, 18, 23, 30, 0, 0, berlin), time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC), "2026-10-19 02:00:00 CEST"},
+		// the time zone's own DST change applies
+		{"*-*-* 02:30 Europe/Berlin", "*-*-* 02:30:00 Europe/Berlin",
+			time.Date(2026, 3, 28, 12, 0, 0, 0, time.UTC), time.Date(2026, 3, 30, 0, 30, 0, 0, time.UTC), "2026-03-30 00:30:00 UTC"},
+	}
+	for _, tt := range tests {
+		spec, err := parseCalendar(tt.expr)
+		if err != nil {
+			t.Errorf("parseCalendar(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := spec.String(); got != tt.want {
+			t.Errorf("parseCalendar(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+		got := spec.Next(tt.after)
+		if !got.Equal(tt.next) {
+			t.Errorf("%q after %s = %s, want %s", tt.expr, tt.after, got, tt.next)
+		}
+		if s := got.Format("2006-01-02 15:04:05 MST"); s != tt.format {
+			t.Errorf("%q after %s = %s, want it in the zone of the start, %s", tt.expr, tt.after, s, tt.format)
+		}
+		if trigger := timerTrigger(tt.expr); trigger != "OnCalendar="+tt.expr+"\n" {
+			t.Errorf("timerTrigger(%q) = %q, want the expression as written", tt.expr, trigger)
+		}
+		if got, err := cronExpression(tt.expr); err == nil {
+			t.Errorf("cronExpression(%q) = %q, want an error", tt.expr, got)
+		}
+	}
+
+	for _, expr := range []string{"*-*-* 03:00 Mars/Olympus", "Mon 02:00 Nowhere"} {
+		if _, err := parseCalendar(expr); err == nil {
+			t.Errorf("parseCalendar(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+type fixedSchedule time.Time
+
+func (s fixedSchedule) Next(after time.Time) time.Time {
+	return time.Time(s)
+}
+
+func TestNextRunNotAfter(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for _, next := range []time.Time{{}, now.Add(-time.Hour), now} {
+		job := &daemonJob{Name: "home", schedule: fixedSchedule(next), jitter: time.Minute}
+		if got := nextRun(job, now); !got.IsZero() {
+			t.Errorf("nextRun with Next = %s is %s, want none", next, got)
+		}
+	}
+	job := &daemonJob{Name: "home", schedule: fixedSchedule(now.Add(time.Hour)), jitter: time.Minute}
+	if got := nextRun(job, now); got.Before(now.Add(time.Hour)) || !got.Before(now.Add(time.Hour+time.Minute)) {
+		t.Errorf("nextRun = %s, want within a minute after %s", got, now.Add(time.Hour))
+	}
+}
@@ -0,0 +1,161 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+type configLocation struct {
+	File string
+	Line int
+}
+
+func (l configLocation) String() string {
+	if l.Line == 0 {
+		return l.File
+	}
+	return fmt.Sprintf("%s:%d", l.File, l.Line)
+}
+
+// configSource records which files a configuration was read from and where
+// each section and key is defined.
+type configSource struct {
+	files    []string
+	data     []interface{}
+	seen     map[string]bool
+	sections map[string]configLocation
+	keys     map[string]configLocation
+}
+
+// locate returns the location of a key, or of its section when the key is
+// not set explicitly.
+func (src *configSource) locate(section, key string) configLocation {
+	if loc, ok := src.keys[section+"\x00"+key]; ok && key != "" {
+		return loc
+	}
+	if loc, ok := src.sections[section]; ok {
+		return loc
+	}
+	return configLocation{File: src.files[0]}
+}
+
+// loadConfig reads path, the files it includes and the drop-ins in the
+// conf.d directory next to it, in that order. A section may only be defined
+// once across all of them. YAML and TOML files are read through their INI
+// rendering, so all formats end up in the same ini.File.
+func loadConfig(path string) (*ini.File, *configSource, error) {
+	src := &configSource{
+		seen:     make(map[string]bool),
+		sections: make(map[string]configLocation),
+		keys:     make(map[string]configLocation),
+	}
+	if err := src.add(path, configLocation{}); err != nil {
+		return nil, src, err
+	}
+	var dropins []string
+	for _, ext := range []string{"*.ini", "*.yaml", "*.yml", "*.toml"} {
+		matches, err := filepath.Glob(filepath.Join(filepath.Dir(path), "conf.d", ext))
+		if err != nil {
+			return nil, src, err
+		}
+		dropins = append(dropins, matches...)
+	}
+	sort.Strings(dropins)
+	for _, file := range dropins {
+		if err := src.add(file, configLocation{}); err != nil {
+			return nil, src, err
+		}
+	}
+
+	cfg, err := ini.Load(src.data[0], src.data[1:]...)
+	if err != nil {
+		return nil, src, err
+	}
+	return cfg, src, nil
+}
+
+// add reads one file and the files it includes. Files which were already
+// read are skipped, so include cycles are harmless.
+func (src *configSource) add(path string, includedFrom configLocation) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if src.seen[abs] {
+		return nil
+	}
+	src.seen[abs] = true
+
+	sections, data, err := parseConfigFile(path)
+	if err != nil {
+		if includedFrom.File != "" {
+			return fmt.Errorf("%s: include: %v", includedFrom, err)
+		}
+		return err
+	}
+	src.files = append(src.files, path)
+	src.data = append(src.data, data)
+
+	type include struct {
+		pattern string
+		loc     configLocation
+	}
+	var includes []include
+	for _, section := range sections {
+		if section.Name != ini.DefaultSection {
+			loc := configLocation{File: path, Line: section.Line}
+			if prev, ok := src.sections[section.Name]; ok {
+				return fmt.Errorf("%s: section [%s] is already defined at %s", loc, section.Name, prev)
+			}
+			src.sections[section.Name] = loc
+		}
+		for _, key := range section.Keys {
+			loc := configLocation{File: path, Line: key.Line}
+			src.keys[section.Name+"\x00"+key.Name] = loc
+			if section.Name == ini.DefaultSection && key.Name == "include" {
+				for _, pattern := range listValue(key.Value) {
+					includes = append(includes, include{strings.Trim(pattern, `"`), loc})
+				}
+			}
+		}
+	}
+
+	for _, inc := range includes {
+		pattern := inc.pattern
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: include: %v", inc.loc, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(inc.pattern, "*?[") {
+			return fmt.Errorf("%s: include: %s does not exist", inc.loc, pattern)
+		}
+		for _, match := range matches {
+			if err := src.add(match, inc.loc); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
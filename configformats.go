@@ -0,0 +1,616 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// configSection is a section of a config file in document order. Keys
+// before the first section belong to ini.DefaultSection.
+type configSection struct {
+	Name string
+	Line int
+	Keys []configKey
+}
+
+type configKey struct {
+	Name  string
+	Value string
+	Line  int
+}
+
+// listKeys are the keys which hold comma separated lists in INI files and
+// lists in YAML and TOML files.
+var listKeys = map[string]bool{
+	"include":            true,
+	"to":                 true,
+	"directory":          true,
+	"exclude":            true,
+	"exclude_file":       true,
+	"iexclude":           true,
+	"exclude_if_present": true,
+	"files_from":         true,
+	"tags":               true,
+	"copy_to":            true,
+	"env":                true,
+	"require_files":      true,
+	"volumes":            true,
+	"inherits":           true,
+}
+
+// listSeparator ends every item of a YAML or TOML list in the rendered INI
+// data, so the items reach listValue as they were written, commas and all.
+const listSeparator = "\x1f"
+
+func structuredList(items []string) string {
+	return strings.Join(items, listSeparator) + listSeparator
+}
+
+// listValue splits a list value: the items of a YAML or TOML list, or a
+// comma separated INI value.
+func listValue(value string) []string {
+	sep := ","
+	if strings.Contains(value, listSeparator) {
+		sep = listSeparator
+	}
+	var items []string
+	for _, item := range strings.Split(value, sep) {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// configFormat returns the format of a config file from its extension.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	}
+	return "ini"
+}
+
+// parseConfigFile returns the sections of a config file together with the
+// data source for ini.Load: the path itself for INI files, or the YAML and
+// TOML documents rendered as INI.
+func parseConfigFile(path string) ([]configSection, interface{}, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var sections []configSection
+	switch configFormat(path) {
+	case "yaml":
+		sections, err = parseYAMLConfig(content)
+	case "toml":
+		sections, err = parseTOMLConfig(content)
+	default:
+		return parseINIConfig(content), path, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return sections, renderINI(sections), nil
+}
+
+// parseINIConfig scans the section headers and keys of an INI file. The
+// values are only trimmed of comments, ini.Load does the actual parsing.
+func parseINIConfig(content []byte) []configSection {
+	sections := []configSection{{Name: ini.DefaultSection}}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == ';' || line[0] == '#' {
+			continue
+		}
+		if line[0] == '[' {
+			if end := strings.Index(line, "]"); end > 0 {
+				sections = append(sections, configSection{Name: strings.TrimSpace(line[1:end]), Line: n})
+			}
+			continue
+		}
+		end := strings.IndexAny(line, "=:")
+		if end <= 0 {
+			continue
+		}
+		value := line[end+1:]
+		if i := strings.IndexAny(value, ";#"); i >= 0 {
+			value = value[:i]
+		}
+		current := &sections[len(sections)-1]
+		current.Keys = append(current.Keys, configKey{Name: strings.TrimSpace(line[:end]), Value: strings.Trim(strings.TrimSpace(value), `"`), Line: n})
+	}
+	return sections
+}
+
+// structuredSections turns a decoded YAML or TOML document into sections.
+// A top level table becomes a section, and a table inside it a job or
+// template section named "outer:inner", so both
+//
+//	dir:
+//	  website:
+//	    bucket: ...
+//
+// and a "dir:website" table describe [dir:website].
+type structuredSections struct {
+	sections []configSection
+	index    map[string]int
+}
+
+func (s *structuredSections) section(name string, line int) *configSection {
+	if i, ok := s.index[name]; ok {
+		return &s.sections[i]
+	}
+	s.index[name] = len(s.sections)
+	s.sections = append(s.sections, configSection{Name: name, Line: line})
+	return &s.sections[len(s.sections)-1]
+}
+
+func (s *structuredSections) add(path []string, value string, line int) error {
+	switch len(path) {
+	case 1:
+		sec := s.section(ini.DefaultSection, 0)
+		sec.Keys = append(sec.Keys, configKey{Name: path[0], Value: value, Line: line})
+	case 2:
+		sec := s.section(path[0], line)
+		sec.Keys = append(sec.Keys, configKey{Name: path[1], Value: value, Line: line})
+	case 3:
+		sec := s.section(path[0]+":"+path[1], line)
+		sec.Keys = append(sec.Keys, configKey{Name: path[2], Value: value, Line: line})
+	default:
+		return fmt.Errorf("line %d: %s is nested too deeply", line, strings.Join(path, "."))
+	}
+	return nil
+}
+
+func parseYAMLConfig(content []byte) ([]configSection, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	s := &structuredSections{index: make(map[string]int)}
+	s.section(ini.DefaultSection, 0)
+	if len(doc.Content) == 0 {
+		return s.sections, nil
+	}
+
+	var walk func(path []string, node *yaml.Node, line int) error
+	walk = func(path []string, node *yaml.Node, line int) error {
+		switch node.Kind {
+		case yaml.MappingNode:
+			// declare the section in document order even when it has no
+			// keys, unless it only groups job sections such as dir:
+			if len(path) == 1 && !onlyMappings(node) {
+				s.section(path[0], line)
+			} else if len(path) == 2 {
+				s.section(path[0]+":"+path[1], line)
+			}
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i], node.Content[i+1]
+				if err := walk(append(append([]string{}, path...), key.Value), value, key.Line); err != nil {
+					return err
+				}
+			}
+			return nil
+		case yaml.SequenceNode:
+			var items []string
+			for _, item := range node.Content {
+				if item.Kind != yaml.ScalarNode {
+					return fmt.Errorf("line %d: lists may only contain plain values", item.Line)
+				}
+				items = append(items, item.Value)
+			}
+			return s.add(path, structuredList(items), line)
+		case yaml.ScalarNode:
+			return s.add(path, node.Value, line)
+		case yaml.AliasNode:
+			return walk(path, node.Alias, line)
+		}
+		return fmt.Errorf("line %d: unsupported value", line)
+	}
+	if root := doc.Content[0]; root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: the document must be a mapping of sections", root.Line)
+	}
+	if err := walk(nil, doc.Content[0], 0); err != nil {
+		return nil, err
+	}
+	return s.sections, nil
+}
+
+func onlyMappings(node *yaml.Node) bool {
+	for i := 1; i < len(node.Content); i += 2 {
+		if node.Content[i].Kind != yaml.MappingNode {
+			return false
+		}
+	}
+	return len(node.Content) > 0
+}
+
+func parseTOMLConfig(content []byte) ([]configSection, error) {
+	var doc map[string]interface{}
+	md, err := toml.Decode(string(content), &doc)
+	if err != nil {
+		return nil, err
+	}
+	lines := tomlLines(content)
+	s := &structuredSections{index: make(map[string]int)}
+	s.section(ini.DefaultSection, 0)
+
+	for _, key := range md.Keys() {
+		path := []string(key)
+		var value interface{} = doc
+		for _, part := range path {
+			value = value.(map[string]interface{})[part]
+		}
+		// keys of inline tables are found at the line of the table
+		var line int
+		for n := len(path); n > 0 && line == 0; n-- {
+			line = lines[strings.Join(path[:n], "\x00")]
+		}
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if len(path) == 1 {
+				if !onlyTables(v) {
+					s.section(path[0], line)
+				}
+			} else if len(path) == 2 {
+				s.section(path[0]+":"+path[1], line)
+			} else {
+				return nil, fmt.Errorf("line %d: %s is nested too deeply", line, key)
+			}
+		case []map[string]interface{}:
+			return nil, fmt.Errorf("line %d: arrays of tables are not supported", line)
+		case []interface{}:
+			var items []string
+			for _, item := range v {
+				switch item.(type) {
+				case map[string]interface{}, []interface{}:
+					return nil, fmt.Errorf("line %d: lists may only contain plain values", line)
+				}
+				items = append(items, fmt.Sprint(item))
+			}
+			if err := s.add(path, structuredList(items), line); err != nil {
+				return nil, err
+			}
+		default:
+			if err := s.add(path, fmt.Sprint(v), line); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return s.sections, nil
+}
+
+func onlyTables(table map[string]interface{}) bool {
+	for _, value := range table {
+		if _, ok := value.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return len(table) > 0
+}
+
+// tomlLines maps the tables and keys of a TOML document to the line they are
+// defined on, keyed by their path joined with "\x00".
+func tomlLines(content []byte) map[string]int {
+	lines := make(map[string]int)
+	var table []string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#':
+		case strings.HasPrefix(line, "[["):
+			if end := strings.LastIndex(line, "]]"); end > 1 {
+				table = tomlKeyPath(line[2:end])
+				if _, ok := lines[strings.Join(table, "\x00")]; !ok {
+					lines[strings.Join(table, "\x00")] = n
+				}
+			}
+		case line[0] == '[':
+			if end := strings.LastIndex(line, "]"); end > 0 {
+				table = tomlKeyPath(line[1:end])
+				lines[strings.Join(table, "\x00")] = n
+			}
+		default:
+			if end := strings.Index(line, "="); end > 0 {
+				path := append(append([]string{}, table...), tomlKeyPath(line[:end])...)
+				if _, ok := lines[strings.Join(path, "\x00")]; !ok {
+					lines[strings.Join(path, "\x00")] = n
+				}
+			}
+		}
+	}
+	return lines
+}
+
+// tomlKeyPath splits a dotted TOML key into its parts.
+func tomlKeyPath(key string) []string {
+	var parts []string
+	var part strings.Builder
+	var quote rune
+	for _, r := range strings.TrimSpace(key) {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			part.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '.':
+			parts = append(parts, strings.TrimSpace(part.String()))
+			part.Reset()
+		default:
+			part.WriteRune(r)
+		}
+	}
+	return append(parts, strings.TrimSpace(part.String()))
+}
+
+// iniValue quotes a value where ini.Load would otherwise change it.
+func iniValue(value string) string {
+	if value == strings.TrimSpace(value) && !strings.ContainsAny(value, ";#\"`\n") {
+		return value
+	}
+	if !strings.ContainsAny(value, "`\n") {
+		return "`" + value + "`"
+	}
+	return `"""` + value + `"""`
+}
+
+func renderINI(sections []configSection) []byte {
+	var buf bytes.Buffer
+	for _, sec := range sections {
+		if sec.Name != ini.DefaultSection {
+			if buf.Len() > 0 {
+				buf.WriteString("\n")
+			}
+			fmt.Fprintf(&buf, "[%s]\n", sec.Name)
+		}
+		for _, key := range sec.Keys {
+			fmt.Fprintf(&buf, "%s = %s\n", key.Name, iniValue(key.Value))
+		}
+	}
+	return buf.Bytes()
+}
+
+// fileSections returns the sections of a single config file as parsed by
+// ini.Load, for converting it to another format.
+func fileSections(path string) ([]configSection, error) {
+	_, data, err := parseConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := ini.Load(data)
+	if err != nil {
+		return nil, err
+	}
+	var sections []configSection
+	for _, section := range cfg.Sections() {
+		sec := configSection{Name: section.Name()}
+		for _, key := range section.Keys() {
+			sec.Keys = append(sec.Keys, configKey{Name: key.Name(), Value: key.Value()})
+		}
+		if sec.Name == ini.DefaultSection || len(sec.Keys) > 0 {
+			sections = append(sections, sec)
+		}
+	}
+	return sections, nil
+}
+
+// splitSectionName returns the path of a section in YAML and TOML files,
+// one element for plain sections and two for "type:name" sections.
+func splitSectionName(name string) []string {
+	if kind, rest, ok := strings.Cut(name, ":"); ok {
+		return []string{kind, rest}
+	}
+	return []string{name}
+}
+
+func yamlScalar(value string) *yaml.Node {
+	node := &yaml.Node{Kind: yaml.ScalarNode, Value: value, Tag: "!!str"}
+	if n, err := strconv.Atoi(value); err == nil && strconv.Itoa(n) == value {
+		node.Tag = "!!int"
+	} else if value == "true" || value == "false" {
+		node.Tag = "!!bool"
+	}
+	return node
+}
+
+// listItems returns the items of a value rendered as a list in YAML and
+// TOML, or nil for a plain value.
+func listItems(key configKey) []string {
+	switch {
+	case strings.Contains(key.Value, listSeparator):
+		return listValue(key.Value)
+	case key.Name == "directory":
+		if items := directoryList(key.Value); len(items) > 1 {
+			return items
+		}
+	case listKeys[key.Name] && strings.Contains(key.Value, ","):
+		return listValue(key.Value)
+	}
+	return nil
+}
+
+// displayValue returns a value as it is written in an INI file.
+func displayValue(value string) string {
+	if !strings.Contains(value, listSeparator) {
+		return value
+	}
+	return strings.Join(listValue(value), ", ")
+}
+
+func yamlValue(key configKey) *yaml.Node {
+	if items := listItems(key); items != nil {
+		list := &yaml.Node{Kind: yaml.SequenceNode}
+		for _, item := range items {
+			list.Content = append(list.Content, yamlScalar(item))
+		}
+		return list
+	}
+	return yamlScalar(key.Value)
+}
+
+func renderYAML(sections []configSection) ([]byte, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	mappings := make(map[string]*yaml.Node)
+	mapping := func(parent *yaml.Node, path []string) *yaml.Node {
+		id := strings.Join(path, "\x00")
+		if node, ok := mappings[id]; ok {
+			return node
+		}
+		node := &yaml.Node{Kind: yaml.MappingNode}
+		parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: path[len(path)-1]}, node)
+		mappings[id] = node
+		return node
+	}
+	for _, sec := range sections {
+		target := root
+		if sec.Name != ini.DefaultSection {
+			path := splitSectionName(sec.Name)
+			target = mapping(root, path[:1])
+			if len(path) == 2 {
+				target = mapping(target, path)
+			}
+		}
+		for _, key := range sec.Keys {
+			target.Content = append(target.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key.Name}, yamlValue(key))
+		}
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+func tomlKey(key string) string {
+	for _, r := range key {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return tomlString(key)
+		}
+	}
+	if key == "" {
+		return `""`
+	}
+	return key
+}
+
+func tomlString(value string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\':
+			sb.WriteString(`\` + string(r))
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&sb, `\u%04X`, r)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+func tomlValue(key configKey) string {
+	scalar := func(value string) string {
+		if n, err := strconv.Atoi(value); err == nil && strconv.Itoa(n) == value {
+			return value
+		}
+		if value == "true" || value == "false" {
+			return value
+		}
+		return tomlString(value)
+	}
+	if list := listItems(key); list != nil {
+		var items []string
+		for _, item := range list {
+			items = append(items, scalar(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return scalar(key.Value)
+}
+
+func renderTOML(sections []configSection) []byte {
+	var buf bytes.Buffer
+	for _, sec := range sections {
+		if sec.Name != ini.DefaultSection {
+			if buf.Len() > 0 {
+				buf.WriteString("\n")
+			}
+			var parts []string
+			for _, part := range splitSectionName(sec.Name) {
+				parts = append(parts, tomlKey(part))
+			}
+			fmt.Fprintf(&buf, "[%s]\n", strings.Join(parts, "."))
+		}
+		for _, key := range sec.Keys {
+			fmt.Fprintf(&buf, "%s = %s\n", tomlKey(key.Name), tomlValue(key))
+		}
+	}
+	return buf.Bytes()
+}
+
+// convertConfig renders the config file at path in another format. Only the
+// file itself is converted, include directives are kept as they are.
+func convertConfig(path, format string) ([]byte, error) {
+	sections, err := fileSections(path)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "yaml":
+		return renderYAML(sections)
+	case "toml":
+		return renderTOML(sections), nil
+	case "ini":
+		for _, sec := range sections {
+			for i, key := range sec.Keys {
+				for _, item := range listValue(key.Value) {
+					if strings.Contains(key.Value, listSeparator) && strings.Contains(item, ",") {
+						return nil, fmt.Errorf("[%s] %s: the item %q contains a comma and cannot be written as an INI list", sec.Name, key.Name, item)
+					}
+				}
+				sec.Keys[i].Value = displayValue(key.Value)
+			}
+		}
+		return renderINI(sections), nil
+	}
+	return nil, fmt.Errorf("unknown format %q, expected yaml, toml or ini", format)
+}
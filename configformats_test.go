@@ -0,0 +1,39 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTOMLErrorLines(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"[smtp]\nenabled = false\n\n[[dir]]\nweb = 1\n", "line 4: arrays of tables are not supported"},
+		{"[smtp]\nenabled = false\n[dir]\nweb = { bucket = \"/r\", opts = { a = 1 } }\n", "line 4: dir.web.opts is nested too deeply"},
+		{"[dir.web]\nbucket = \"/r\"\nopts = { a = { b = 1 } }\n", "line 3: dir.web.opts is nested too deeply"},
+		{"[dir.web]\ndirectory = [[\"/a\"]]\n", "line 2: lists may only contain plain values"},
+	}
+	for _, tt := range tests {
+		_, err := parseTOMLConfig([]byte(tt.content))
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseTOMLConfig(%q) error = %v, want %q", tt.content, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ContainerJob backs up a Docker or Podman container, from
+// [container:NAME] sections: either the volumes and bind mounts of the
+// container, or the output of a dump command run inside it.
+type ContainerJob struct {
+	JobSettings
+	Container    string
+	Runtime      string
+	Quiesce      string
+	Volumes      []string
+	DumpCommand  string
+	DumpFilename string
+}
+
+func init() {
+	registerJobType("container", jobType{
+		required: []string{"bucket", "retention_daily", "retention_weekly", "retention_monthly"},
+		optional: []string{"container", "runtime", "quiesce", "volumes", "dump_command", "dump_filename"},
+		new: func(common JobSettings, settings map[string]string) Job {
+			job := &ContainerJob{
+				JobSettings:  common,
+				Container:    strings.TrimSpace(settings["container"]),
+				Runtime:      strings.TrimSpace(settings["runtime"]),
+				Quiesce:      strings.TrimSpace(settings["quiesce"]),
+				Volumes:      listValue(settings["volumes"]),
+				DumpCommand:  strings.TrimSpace(settings["dump_command"]),
+				DumpFilename: strings.TrimSpace(settings["dump_filename"]),
+			}
+			if job.Container == "" {
+				job.Container = common.Name
+			}
+			if job.Runtime == "" {
+				job.Runtime = "docker"
+			}
+			if job.Quiesce == "" {
+				job.Quiesce = "none"
+			}
+			if job.DumpFilename == "" {
+				job.DumpFilename = job.Container + ".dump"
+			}
+			return job
+		},
+	})
+}
+
+func (j *ContainerJob) Settings() *JobSettings {
+	return &j.JobSettings
+}
+
+func (j *ContainerJob) Validate() []settingError {
+	var errs []settingError
+	if j.Runtime != "docker" && j.Runtime != "podman" {
+		errs = append(errs, settingError{j.Key, "runtime", fmt.Errorf("must be docker or podman")})
+	}
+	switch j.Quiesce {
+	case "none", "pause", "stop":
+	default:
+		errs = append(errs, settingError{j.Key, "quiesce", fmt.Errorf("must be none, pause or stop")})
+	}
+	if j.DumpCommand != "" {
+		if j.Quiesce != "none" {
+			errs = append(errs, settingError{j.Key, "quiesce", fmt.Errorf("cannot be combined with 'dump_command', which needs the container running")})
+		}
+		if len(j.Volumes) > 0 {
+			errs = append(errs, settingError{j.Key, "volumes", fmt.Errorf("cannot be combined with 'dump_command'")})
+		}
+	}
+	if strings.ContainsAny(j.DumpFilename, "/ \t") {
+		errs = append(errs, settingError{j.Key, "dump_filename", fmt.Errorf("must be a plain file name")})
+	}
+	return errs
+}
+
+// containerInfo is the part of the output of docker and podman inspect
+// the job needs.
+type containerInfo struct {
+	State struct {
+		Running bool
+		Paused  bool
+	}
+	Mounts []struct {
+		Type        string
+		Name        string
+		Source      string
+		Destination string
+	}
+}
+
+func (j *ContainerJob) inspect() (containerInfo, error) {
+	out, err := commandOutput(j.Runtime, "inspect", "--type", "container", j.Container)
+	if err != nil {
+		return containerInfo{}, err
+	}
+	var infos []containerInfo
+	if err := json.Unmarshal([]byte(out), &infos); err != nil {
+		return containerInfo{}, fmt.Errorf("parsing %s inspect: %v", j.Runtime, err)
+	}
+	if len(infos) != 1 {
+		return containerInfo{}, fmt.Errorf("container %s not found", j.Container)
+	}
+	return infos[0], nil
+}
+
+// sources returns the host paths of the container's volumes and bind
+// mounts, limited to the configured volumes.
+func (j *ContainerJob) sources(info containerInfo) ([]string, error) {
+	var paths []string
+	found := make(map[string]bool)
+	for _, m := range info.Mounts {
+		if m.Type != "volume" && m.Type != "bind" {
+			continue
+		}
+		if len(j.Volumes) > 0 {
+			name := m.Name
+			if indexOf(j.Volumes, m.Destination) >= 0 {
+				name = m.Destination
+			} else if name == "" || indexOf(j.Volumes, name) < 0 {
+				continue
+			}
+			found[name] = true
+		}
+		paths = append(paths, m.Source)
+	}
+	for _, name := range j.Volumes {
+		if !found[name] {
+			return nil, fmt.Errorf("container %s has no volume or mount %s", j.Container, name)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("container %s has no volumes or bind mounts", j.Container)
+	}
+	return paths, nil
+}
+
+// Preflight checks that the runtime is installed and the container exists,
+// and for dump_command that it is running.
+func (j *ContainerJob) Preflight() error {
+	if _, err := exec.LookPath(j.Runtime); err != nil {
+		return fmt.Errorf("%s not found in PATH", j.Runtime)
+	}
+	info, err := j.inspect()
+	if err != nil {
+		return err
+	}
+	if j.DumpCommand != "" {
+		if !info.State.Running || info.State.Paused {
+			return fmt.Errorf("container %s is not running", j.Container)
+		}
+		return nil
+	}
+	_, err = j.sources(info)
+	return err
+}
+
+// Prepare discovers the volumes of the container and pauses or stops it
+// for the backup. The cleanup resumes the container.
+func (j *ContainerJob) Prepare() (pipeline, func() error, error) {
+	noop := func() error { return nil }
+	if j.DumpCommand != "" {
+		return j.BackupPipeline(), noop, nil
+	}
+	info, err := j.inspect()
+	if err != nil {
+		return pipeline{}, noop, err
+	}
+	paths, err := j.sources(info)
+	if err != nil {
+		return pipeline{}, noop, err
+	}
+	backup := pipeline{Restic: append(j.backupArgs(), paths...)}
+
+	// a container which is not running is left alone
+	if !info.State.Running || info.State.Paused {
+		return backup, noop, nil
+	}
+	switch j.Quiesce {
+	case "pause":
+		if _, err := commandOutput(j.Runtime, "pause", j.Container); err != nil {
+			return backup, noop, err
+		}
+		return backup, func() error {
+			_, err := commandOutput(j.Runtime, "unpause", j.Container)
+			return err
+		}, nil
+	case "stop":
+		if _, err := commandOutput(j.Runtime, "stop", j.Container); err != nil {
+			return backup, noop, err
+		}
+		return backup, func() error {
+			_, err := commandOutput(j.Runtime, "start", j.Container)
+			return err
+		}, nil
+	}
+	return backup, noop, nil
+}
+
+// BackupPipeline streams the dump command into restic. The volumes are
+// only known when the job runs, see Prepare.
+func (j *ContainerJob) BackupPipeline() pipeline {
+	if j.DumpCommand == "" {
+		return pipeline{Restic: j.backupArgs()}
+	}
+	return pipeline{
+		Dump:   []string{j.Runtime, "exec", j.Container, "/bin/sh", "-c", j.DumpCommand},
+		Restic: append(j.backupArgs(), "--stdin", "--stdin-filename", j.DumpFilename),
+	}
+}
+
+func (j *ContainerJob) ReadPaths() []string {
+	return nil
+}
+
+func (j *ContainerJob) Describe() string {
+	if j.DumpCommand != "" {
+		return "dump of container " + j.Container
+	}
+	if len(j.Volumes) > 0 {
+		return "volumes " + strings.Join(j.Volumes, ", ") + " of container " + j.Container
+	}
+	return "volumes of container " + j.Container
+}
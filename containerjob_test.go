@@ -0,0 +1,151 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func inspectJSON(running bool) string {
+	return fmt.Sprintf(`[{"State": {"Running": %t, "Paused": false}, "Mounts": [
+		{"Type": "volume", "Name": "webdata", "Source": "/var/lib/docker/volumes/webdata/_data", "Destination": "/data"},
+		{"Type": "bind", "Source": "/srv/web/config", "Destination": "/etc/app"},
+		{"Type": "tmpfs", "Destination": "/tmp"}
+	]}]`, running)
+}
+
+func TestContainerSources(t *testing.T) {
+	var infos []containerInfo
+	if err := json.Unmarshal([]byte(inspectJSON(true)), &infos); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		volumes []string
+		want    []string
+		err     string
+	}{
+		{want: []string{"/var/lib/docker/volumes/webdata/_data", "/srv/web/config"}},
+		{volumes: []string{"webdata"}, want: []string{"/var/lib/docker/volumes/webdata/_data"}},
+		{volumes: []string{"/etc/app"}, want: []string{"/srv/web/config"}},
+		{volumes: []string{"webdata", "/etc/app"}, want: []string{"/var/lib/docker/volumes/webdata/_data", "/srv/web/config"}},
+		{volumes: []string{"/tmp"}, err: "has no volume or mount /tmp"},
+		{volumes: []string{"logs"}, err: "has no volume or mount logs"},
+	} {
+		job := &ContainerJob{Container: "web", Volumes: tc.volumes}
+		got, err := job.sources(infos[0])
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("sources(%q) error = %v, want %q", tc.volumes, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("sources(%q) = %q, %v, want %q", tc.volumes, got, err, tc.want)
+		}
+	}
+
+	job := &ContainerJob{Container: "web"}
+	if _, err := job.sources(containerInfo{}); err == nil {
+		t.Error("sources() of a container without mounts succeeded")
+	}
+}
+
+// fakeDocker puts a docker stand-in on PATH which answers inspect with the
+// given JSON and logs its calls to the returned file.
+func fakeDocker(t *testing.T, inspect string) string {
+	t.Helper()
+	dir := t.TempDir()
+	log := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$*\" >> " + log + "\ncase \"$1\" in inspect) cat " + filepath.Join(dir, "inspect") + ";; esac\n"
+	if err := os.WriteFile(filepath.Join(dir, "docker"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "inspect"), []byte(inspect), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return log
+}
+
+func dockerCalls(t *testing.T, log string) []string {
+	t.Helper()
+	content, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(content)), "\n")
+}
+
+func TestContainerPrepare(t *testing.T) {
+	for _, tc := range []struct {
+		quiesce string
+		running bool
+		before  []string
+		after   []string
+	}{
+		{quiesce: "none", running: true},
+		{quiesce: "pause", running: true, before: []string{"pause web"}, after: []string{"unpause web"}},
+		{quiesce: "stop", running: true, before: []string{"stop web"}, after: []string{"start web"}},
+		// a stopped container is left alone
+		{quiesce: "stop", running: false},
+	} {
+		t.Run(fmt.Sprintf("%s running=%t", tc.quiesce, tc.running), func(t *testing.T) {
+			log := fakeDocker(t, inspectJSON(tc.running))
+			job := &ContainerJob{JobSettings: JobSettings{Key: "container:web", Bucket: "/repo"}, Container: "web", Runtime: "docker", Quiesce: tc.quiesce}
+
+			backup, cleanup, err := job.Prepare()
+			if err != nil {
+				t.Fatalf("Prepare() error = %v", err)
+			}
+			args := backup.Restic
+			if got := args[len(args)-2:]; !reflect.DeepEqual(got, []string{"/var/lib/docker/volumes/webdata/_data", "/srv/web/config"}) {
+				t.Errorf("backup paths = %q", got)
+			}
+			inspect := "inspect --type container web"
+			if got, want := dockerCalls(t, log), append([]string{inspect}, tc.before...); !reflect.DeepEqual(got, want) {
+				t.Errorf("calls before the backup = %q, want %q", got, want)
+			}
+
+			if err := cleanup(); err != nil {
+				t.Fatalf("cleanup() error = %v", err)
+			}
+			if got, want := dockerCalls(t, log), append(append([]string{inspect}, tc.before...), tc.after...); !reflect.DeepEqual(got, want) {
+				t.Errorf("calls after the backup = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestContainerDumpPipeline(t *testing.T) {
+	job := &ContainerJob{
+		JobSettings:  JobSettings{Key: "container:db", Bucket: "/repo"},
+		Container:    "postgres",
+		Runtime:      "podman",
+		DumpCommand:  "pg_dump -U postgres shop",
+		DumpFilename: "shop.sql",
+	}
+	got := job.BackupPipeline().String()
+	want := "podman exec postgres /bin/sh -c 'pg_dump -U postgres shop' | restic -r /repo backup --tag resticara --tag container:db --stdin --stdin-filename shop.sql"
+	if got != want {
+		t.Errorf("BackupPipeline() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const repositoryPrefix = "repository:"
+
+// repositoryKeys lists the keys of [repository:NAME] sections.
+var repositoryKeys = []string{"bucket", "password", "env", "retention_daily", "retention_weekly", "retention_monthly"}
+
+// Repository is a secondary repository which jobs replicate their snapshots
+// to with copy_to, from [repository:NAME] sections.
+type Repository struct {
+	Name     string
+	Bucket   string
+	Password string
+	Env      []string
+	// Retention overrides the retention of the copied job when set.
+	RetentionDaily   *int
+	RetentionWeekly  *int
+	RetentionMonthly *int
+}
+
+func newRepository(name string, settings map[string]string) (Repository, []settingError) {
+	section := repositoryPrefix + name
+	repo := Repository{Name: name, Bucket: strings.TrimSpace(settings["bucket"]), Password: settings["password"]}
+	var errs []settingError
+	if repo.Bucket == "" {
+		errs = append(errs, settingError{section, "bucket", errMissing})
+	}
+	for _, env := range listValue(settings["env"]) {
+		if name, _, ok := strings.Cut(env, "="); !ok || name == "" {
+			errs = append(errs, settingError{section, "env", fmt.Errorf("%q is not a NAME=value pair", env)})
+			continue
+		}
+		repo.Env = append(repo.Env, env)
+	}
+	for key, target := range map[string]**int{
+		"retention_daily":   &repo.RetentionDaily,
+		"retention_weekly":  &repo.RetentionWeekly,
+		"retention_monthly": &repo.RetentionMonthly,
+	} {
+		if val, ok := settings[key]; ok {
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				errs = append(errs, settingError{section, key, fmt.Errorf("must be an integer")})
+				continue
+			}
+			*target = &n
+		}
+	}
+	return repo, errs
+}
+
+// passwordEnv lists the variables restic reads the repository password
+// from. restic copy reads the password of the source repository from the
+// same names with RESTIC_FROM_ in place of RESTIC_.
+var passwordEnv = []string{"RESTIC_PASSWORD", "RESTIC_PASSWORD_FILE", "RESTIC_PASSWORD_COMMAND"}
+
+// resticEnv returns the environment of restic calls writing to the
+// repository. Its password replaces any inherited from the environment,
+// where a password file or command would take precedence.
+func (r Repository) resticEnv() []string {
+	env := append([]string{}, r.Env...)
+	if r.Password != "" {
+		env = append(env, "RESTIC_PASSWORD="+r.Password, "RESTIC_PASSWORD_FILE=", "RESTIC_PASSWORD_COMMAND=")
+	}
+	return env
+}
+
+// copyEnv returns the environment of restic copy from the job's repository
+// into repo. Without a password key the job's repository is opened with the
+// password from the environment of resticara, which is passed on as the
+// RESTIC_FROM_ variables.
+func copyEnv(settings *JobSettings, repo Repository) []string {
+	env := repo.resticEnv()
+	if settings.Password != "" {
+		return append(env, "RESTIC_FROM_PASSWORD="+settings.Password)
+	}
+	for _, name := range passwordEnv {
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, strings.Replace(name, "RESTIC_", "RESTIC_FROM_", 1)+"="+value)
+		}
+	}
+	return env
+}
+
+func copyPipeline(settings *JobSettings, repo Repository, snapshotID string) pipeline {
+	return pipeline{Restic: []string{"restic", "-r", repo.Bucket, "copy", "--from-repo", settings.Bucket, snapshotID}}
+}
+
+// copyForgetPipeline applies the retention of repo, or of the job where the
+// repository does not set its own, to the job's snapshots in repo.
+func copyForgetPipeline(settings *JobSettings, repo Repository) pipeline {
+	daily, weekly, monthly := settings.RetentionDaily, settings.RetentionWeekly, settings.RetentionMonthly
+	if repo.RetentionDaily != nil {
+		daily = *repo.RetentionDaily
+	}
+	if repo.RetentionWeekly != nil {
+		weekly = *repo.RetentionWeekly
+	}
+	if repo.RetentionMonthly != nil {
+		monthly = *repo.RetentionMonthly
+	}
+	return settings.forgetPipeline(repo.Bucket, daily, weekly, monthly)
+}
+
+// jobRepositories returns the job's repository followed by the repositories
+// it copies to, which are pruned together.
+func jobRepositories(config Config, settings *JobSettings) []string {
+	repos := []string{settings.Bucket}
+	for _, name := range settings.CopyTo {
+		if repo, ok := config.Repositories[name]; ok && indexOf(repos, repo.Bucket) < 0 {
+			repos = append(repos, repo.Bucket)
+		}
+	}
+	return repos
+}
+
+// copySnapshot replicates the snapshot created by a job into one secondary
+// repository and applies the retention there. The retention is only applied
+// after a successful copy.
+func copySnapshot(runner DefaultCommandRunner, settings *JobSettings, repo Repository, snapshotID string, logger *slog.Logger) CopyInfo {
+	info := CopyInfo{Repository: repo.Name}
+	if snapshotID == "" {
+		info.CopyError = "no snapshot ID found in the backup output"
+		logger.Error("copy failed", "job", settings.Key, "phase", "copy", "repo", repo.Bucket, "status", "failed", "error", info.CopyError)
+		return info
+	}
+
+	copyCmd := copyPipeline(settings, repo, snapshotID)
+	start := time.Now()
+	success, stdout, stderr := runner.Run(copyCmd, copyEnv(settings, repo))
+	duration := time.Since(start)
+	logPhase(logger, settings.Key, "copy", repo.Bucket, duration, success, stdout, stderr)
+	info.CopyCmd = copyCmd.String()
+	info.CopyOutput = stdout + "\nStderr: " + stderr
+	info.CopySuccess = success
+	info.CopySeconds = duration.Seconds()
+	if !success {
+		info.CopyError = lastLine(stderr)
+		return info
+	}
+
+	forgetCmd := copyForgetPipeline(settings, repo)
+	start = time.Now()
+	success, stdout, stderr = runner.Run(forgetCmd, repo.resticEnv())
+	duration = time.Since(start)
+	logPhase(logger, settings.Key, "forget", repo.Bucket, duration, success, stdout, stderr)
+	info.ForgetCmd = forgetCmd.String()
+	info.ForgetOutput = stdout + "\nStderr: " + stderr
+	info.ForgetSuccess = success
+	info.ForgetSeconds = duration.Seconds()
+	if !success {
+		info.ForgetError = lastLine(stderr)
+	}
+	return info
+}
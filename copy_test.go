@@ -0,0 +1,138 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCopyEnv(t *testing.T) {
+	for _, name := range passwordEnv {
+		t.Setenv(name, "")
+		os.Unsetenv(name)
+	}
+	t.Setenv("RESTIC_PASSWORD_FILE", "/etc/restic.pass")
+
+	repo := Repository{Name: "offsite", Password: "dst"}
+	env := copyEnv(&JobSettings{}, repo)
+	for _, want := range []string{"RESTIC_PASSWORD=dst", "RESTIC_PASSWORD_FILE=", "RESTIC_FROM_PASSWORD_FILE=/etc/restic.pass"} {
+		if !slices.Contains(env, want) {
+			t.Errorf("copyEnv() = %q, missing %q", env, want)
+		}
+	}
+
+	env = copyEnv(&JobSettings{Password: "src"}, repo)
+	if !slices.Contains(env, "RESTIC_FROM_PASSWORD=src") || slices.Contains(env, "RESTIC_FROM_PASSWORD_FILE=/etc/restic.pass") {
+		t.Errorf("copyEnv() with a job password = %q", env)
+	}
+}
+
+// TestCopySnapshot replicates a snapshot between two local repositories
+// with the real restic, with the source password set in the job or only in
+// the environment.
+func TestCopySnapshot(t *testing.T) {
+	if _, err := exec.LookPath("restic"); err != nil {
+		t.Skip("restic is not installed")
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	for _, tc := range []struct {
+		name     string
+		password string
+		env      map[string]string
+	}{
+		{name: "job password", password: "source"},
+		{name: "RESTIC_PASSWORD", env: map[string]string{"RESTIC_PASSWORD": "source"}},
+		{name: "RESTIC_PASSWORD_FILE", env: map[string]string{"RESTIC_PASSWORD_FILE": "PASSFILE"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range passwordEnv {
+				t.Setenv(name, "")
+				os.Unsetenv(name)
+			}
+			t.Setenv("RESTIC_CACHE_DIR", filepath.Join(dir, "cache"))
+			passFile := filepath.Join(dir, "pass")
+			if err := os.WriteFile(passFile, []byte("source\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range tc.env {
+				if value == "PASSFILE" {
+					value = passFile
+				}
+				t.Setenv(name, value)
+			}
+
+			data := filepath.Join(dir, "data")
+			if err := os.MkdirAll(data, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(data, "file"), []byte("content"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			settings := &JobSettings{
+				Key:              "dir:test",
+				Bucket:           filepath.Join(dir, "source"),
+				Password:         tc.password,
+				GroupBy:          "host,tags",
+				RetentionDaily:   1,
+				RetentionWeekly:  1,
+				RetentionMonthly: 1,
+			}
+			repo := Repository{Name: "copy", Bucket: filepath.Join(dir, "copy"), Password: "copy"}
+			sourceEnv := []string{"RESTIC_PASSWORD=source"}
+
+			run := func(p pipeline, env []string) string {
+				t.Helper()
+				success, stdout, stderr := cmdSuccess(p, env)
+				if !success {
+					t.Fatalf("%s failed: %s", p, stderr)
+				}
+				return stdout
+			}
+			run(pipeline{Restic: []string{"restic", "-r", settings.Bucket, "init"}}, sourceEnv)
+			run(pipeline{Restic: []string{"restic", "-r", repo.Bucket, "init"}}, repo.resticEnv())
+			id := parseSnapshotID(run(pipeline{Restic: append(settings.backupArgs(), data)}, sourceEnv))
+			if id == "" {
+				t.Fatal("no snapshot ID in the backup output")
+			}
+
+			info := copySnapshot(DefaultCommandRunner{}, settings, repo, id, logger)
+			if !info.CopySuccess || !info.ForgetSuccess {
+				t.Fatalf("copySnapshot() = %+v", info)
+			}
+
+			var snapshots []struct {
+				Tags []string `json:"tags"`
+			}
+			out := run(pipeline{Restic: []string{"restic", "-r", repo.Bucket, "snapshots", "--json"}}, repo.resticEnv())
+			if err := json.Unmarshal([]byte(out), &snapshots); err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshots) != 1 || !slices.Contains(snapshots[0].Tags, "dir:test") {
+				t.Errorf("snapshots in the copy repository = %+v", snapshots)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cronOptions struct {
+	DryRun     bool
+	File       string
+	User       string
+	Binary     string
+	ConfigPath string
+}
+
+// cronExpression converts a schedule accepted by parseSchedule into the five
+// cron fields. Intervals are only supported when they divide an hour or a
+// day evenly, intervals of days are approximated with a day of month step.
+func cronExpression(expr string) (string, error) {
+	schedule, err := parseSchedule(expr)
+	if err != nil {
+		return "", err
+	}
+	switch s := schedule.(type) {
+	case intervalSchedule:
+		switch {
+		case s.every%time.Minute != 0:
+			return "", fmt.Errorf("interval %q is not a whole number of minutes", expr)
+		case s.every < time.Hour && time.Hour%s.every == 0:
+			return fmt.Sprintf("*/%d * * * *", int(s.every/time.Minute)), nil
+		case s.every < 24*time.Hour && s.every%time.Hour == 0 && (24*time.Hour)%s.every == 0:
+			return fmt.Sprintf("0 */%d * * *", int(s.every/time.Hour)), nil
+		case s.every%(24*time.Hour) == 0 && s.every <= 31*24*time.Hour:
+			days := int(s.every / (24 * time.Hour))
+			if days == 1 {
+				return "0 0 * * *", nil
+			}
+			return fmt.Sprintf("0 0 */%d * *", days), nil
+		}
+		return "", fmt.Errorf("interval %q cannot be expressed in cron", expr)
+	case *calendarSpec:
+		if s.years != nil {
+			return "", fmt.Errorf("schedule %q restricts the year, which cron does not support", expr)
+		}
+		if s.location != nil {
+			return "", fmt.Errorf("schedule %q sets a time zone, which cron does not support", expr)
+		}
+		if len(s.seconds) != 1 || s.seconds[0] != 0 {
+			return "", fmt.Errorf("schedule %q runs at seconds other than :00, which cron does not support", expr)
+		}
+		if s.days != nil && s.weekdays != nil {
+			return "", fmt.Errorf("schedule %q restricts both the day of month and the weekday, which cron does not support", expr)
+		}
+		join := func(values []int) string {
+			if values == nil {
+				return "*"
+			}
+			parts := make([]string, len(values))
+			for i, v := range values {
+				parts[i] = strconv.Itoa(v)
+			}
+			return strings.Join(parts, ",")
+		}
+		return strings.Join([]string{join(s.minutes), join(s.hours), join(s.days), join(s.months), join(s.weekdays)}, " "), nil
+	}
+	return "", fmt.Errorf("unsupported schedule %q", expr)
+}
+
+func shellQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n'\"\\$`!*?[]{}()<>|&;#~") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// renderCron returns the content of the cron.d file with one line per job
+// and one per prune schedule. Every command is wrapped in flock so a run is
+// skipped while the previous one is still active.
+func renderCron(config Config, opts cronOptions) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("# Generated by resticara gencron, do not edit.\n")
+	sb.WriteString("SHELL=/bin/sh\n")
+	sb.WriteString("PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin\n")
+
+	command := func(lock string, args ...string) string {
+		parts := []string{"flock", "-n", shellQuote("/run/lock/" + lock + ".lock"), shellQuote(opts.Binary)}
+		if opts.ConfigPath != "" {
+			parts = append(parts, shellQuote("--config="+opts.ConfigPath))
+		}
+		for _, a := range args {
+			parts = append(parts, shellQuote(a))
+		}
+		// an unescaped % starts the standard input of the command in crontab
+		return strings.ReplaceAll(strings.Join(parts, " "), "%", `\%`)
+	}
+
+	for _, commandKey := range sortedJobKeys(config) {
+		settings := config.Jobs[commandKey].Settings()
+		sanitized := sanitizeName(commandKey)
+
+		backupCron, err := cronExpression(settings.Schedule)
+		if err != nil {
+			return "", fmt.Errorf("schedule for %s: %v", commandKey, err)
+		}
+
+		pruneDays, pruneSchedule := prunePolicy(config, settings)
+		if pruneSchedule == "" {
+			pruneSchedule = fmt.Sprintf("@every %dd", pruneDays)
+		}
+		pruneCron, err := cronExpression(pruneSchedule)
+		if err != nil {
+			return "", fmt.Errorf("prune schedule for %s: %v", commandKey, err)
+		}
+
+		fmt.Fprintf(&sb, "\n# %s\n", commandKey)
+		fmt.Fprintf(&sb, "%s %s %s\n", backupCron, opts.User, command(unitPrefix(config)+sanitized, "run", commandKey))
+		fmt.Fprintf(&sb, "%s %s %s\n", pruneCron, opts.User, command(unitPrefix(config)+sanitized+"-prune", append([]string{"prune"}, jobRepositories(config, settings)...)...))
+	}
+	return sb.String(), nil
+}
+
+type cronReport struct {
+	Path     string `json:"path"`
+	DryRun   bool   `json:"dry_run"`
+	Content  string `json:"content"`
+	ExitCode int    `json:"exit_code"`
+}
+
+func generateCron(config Config, opts cronOptions) (cronReport, error) {
+	report := cronReport{Path: opts.File, DryRun: opts.DryRun}
+	content, err := renderCron(config, opts)
+	if err != nil {
+		return report, err
+	}
+	report.Content = content
+	if opts.DryRun {
+		fmt.Print(content)
+		return report, nil
+	}
+	if err := os.WriteFile(opts.File, []byte(content), 0644); err != nil {
+		return report, err
+	}
+	fmt.Printf("Cron file written to %s.\n", opts.File)
+	return report, nil
+}
@@ -0,0 +1,378 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type daemonJob struct {
+	Name         string    `json:"name"`
+	Kind         string    `json:"kind"`
+	Target       string    `json:"target"`
+	Schedule     string    `json:"schedule"`
+	NextRun      time.Time `json:"next_run"`
+	LastRun      time.Time `json:"last_run"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastStatus   string    `json:"last_status,omitempty"`
+
+	schedule jobSchedule
+	jitter   time.Duration
+	repos    []string
+}
+
+// daemon runs the configured jobs on their schedules without relying on
+// systemd timers or cron.
+type daemon struct {
+	mu           sync.Mutex
+	configPath   string
+	templatePath string
+	logger       *slog.Logger
+	config       Config
+	jobs         []*daemonJob
+	// stopping is set on SIGTERM or SIGINT, no further jobs start then.
+	stopping bool
+}
+
+// load builds the job list from config, keeping the run history of jobs
+// which are still configured.
+func (d *daemon) load(config Config) {
+	previous := make(map[string]*daemonJob)
+	for _, job := range d.jobs {
+		previous[job.Name] = job
+	}
+
+	var jobs []*daemonJob
+	now := time.Now()
+	for commandKey, job := range config.Jobs {
+		settings := job.Settings()
+		var jitter time.Duration
+		if settings.RandomizedDelay != "" {
+			jitter, _ = parseTimeSpan(settings.RandomizedDelay)
+		}
+		pruneDays, pruneSchedule := prunePolicy(config, settings)
+		if pruneSchedule == "" {
+			pruneSchedule = fmt.Sprintf("@every %dd", pruneDays)
+		}
+
+		for _, job := range []*daemonJob{
+			{Name: commandKey, Kind: "backup", Target: commandKey, Schedule: settings.Schedule, jitter: jitter},
+			{Name: commandKey + " prune", Kind: "prune", Target: settings.Bucket, Schedule: pruneSchedule, repos: jobRepositories(config, settings)},
+		} {
+			parsed, err := parseSchedule(job.Schedule)
+			if err != nil {
+				// readConfig has already validated the schedules
+				continue
+			}
+			job.schedule = parsed
+			job.NextRun = nextRun(job, now)
+			if old, ok := previous[job.Name]; ok {
+				job.LastRun, job.LastDuration, job.LastStatus = old.LastRun, old.LastDuration, old.LastStatus
+				// keep the planned run, or schedule from the last one after a
+				// change, so restarts and reloads do not postpone interval
+				// schedules; missed runs are due at once
+				if old.Schedule == job.Schedule && !old.NextRun.IsZero() {
+					job.NextRun = old.NextRun
+				} else if !old.LastRun.IsZero() && old.LastRun.Before(now) {
+					job.NextRun = nextRun(job, old.LastRun)
+				}
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+
+	d.mu.Lock()
+	d.config = config
+	d.jobs = jobs
+	d.mu.Unlock()
+}
+
+// daemonStatePath returns the file keeping the last runs of the daemon's
+// jobs across restarts.
+func daemonStatePath(config Config) string {
+	return filepath.Join(stateDir(), unitPrefix(config)+"daemon.json")
+}
+
+// loadDaemonState returns the jobs recorded by saveState. A missing file is
+// not an error.
+func loadDaemonState(path string) ([]*daemonJob, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var jobs []*daemonJob
+	if err := json.Unmarshal(content, &jobs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return jobs, nil
+}
+
+func (d *daemon) saveState() error {
+	d.mu.Lock()
+	content, err := json.MarshalIndent(d.jobs, "", "  ")
+	path := daemonStatePath(d.config)
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func nextRun(job *daemonJob, after time.Time) time.Time {
+	next := job.schedule.Next(after)
+	if !next.After(after) {
+		// Never schedule a run in the past, it would run over and over.
+		return time.Time{}
+	}
+	if job.jitter <= 0 {
+		return next
+	}
+	return next.Add(time.Duration(rand.Int63n(int64(job.jitter))))
+}
+
+func (d *daemon) nextDue() (time.Time, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var earliest time.Time
+	for _, job := range d.jobs {
+		if job.NextRun.IsZero() {
+			continue
+		}
+		if earliest.IsZero() || job.NextRun.Before(earliest) {
+			earliest = job.NextRun
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+func (d *daemon) runDue() {
+	d.mu.Lock()
+	config := d.config
+	var due []*daemonJob
+	for _, job := range d.jobs {
+		if !job.NextRun.IsZero() && !job.NextRun.After(time.Now()) {
+			due = append(due, job)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, job := range due {
+		d.mu.Lock()
+		stopping := d.stopping
+		d.mu.Unlock()
+		if stopping {
+			return
+		}
+
+		start := time.Now()
+		var exitCode int
+		switch job.Kind {
+		case "backup":
+			var err error
+			_, exitCode, err = runBackups(config, []string{job.Target}, d.templatePath, d.logger)
+			if err != nil {
+				fmt.Println(err)
+				d.logger.Error("job failed", "job", job.Name, "error", err)
+			}
+		case "prune":
+			var failed, succeeded, locked int
+			for _, repo := range job.repos {
+				switch pruneRepository(repo, repositoryEnv(config, repo), d.logger).ExitCode {
+				case exitOK:
+					succeeded++
+				case exitLocked:
+					locked++
+				default:
+					failed++
+				}
+			}
+			exitCode = jobsExitCode(failed, succeeded, locked)
+		}
+
+		status := "success"
+		switch exitCode {
+		case exitOK:
+		case exitLocked:
+			status = "skipped"
+		case exitNotifyFailed:
+			status = "notification failed"
+		default:
+			status = "failed"
+			d.logger.Error("job failed", "job", job.Name, "status", status)
+		}
+
+		d.mu.Lock()
+		job.LastRun = start
+		job.LastDuration = time.Since(start).Round(time.Second).String()
+		job.LastStatus = status
+		if d.stopping && exitCode != exitOK {
+			// keep it due, so the next start runs it again
+			job.LastStatus = "interrupted"
+		} else {
+			job.NextRun = nextRun(job, time.Now())
+		}
+		d.mu.Unlock()
+		if job.NextRun.IsZero() {
+			d.logger.Error("no next run", "job", job.Name, "schedule", job.Schedule)
+		}
+
+		if err := d.saveState(); err != nil {
+			fmt.Printf("Error saving the daemon state: %v\n", err)
+			d.logger.Error("saving daemon state failed", "error", err)
+		}
+	}
+}
+
+func (d *daemon) reload() {
+	config, err := readConfig(d.configPath)
+	if err != nil {
+		fmt.Printf("Error reloading config, keeping the previous one: %v\n", err)
+		d.logger.Error("config reload failed", "config", d.configPath, "error", err)
+		return
+	}
+	d.load(config)
+	fmt.Printf("Configuration reloaded from %s\n", d.configPath)
+	d.logger.Info("config reloaded", "config", d.configPath, "jobs", len(d.jobs))
+}
+
+func (d *daemon) serveStatus(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	status := struct {
+		HostID string       `json:"host_id"`
+		Jobs   []*daemonJob `json:"jobs"`
+	}{HostID: resolveHostID(d.config), Jobs: d.jobs}
+	body, err := json.MarshalIndent(status, "", "  ")
+	d.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func runDaemon(config Config, configPath, templatePath string, logger *slog.Logger) error {
+	d := &daemon{configPath: configPath, templatePath: templatePath, logger: logger}
+	jobs, err := loadDaemonState(daemonStatePath(config))
+	if err != nil {
+		fmt.Printf("Error reading the daemon state, scheduling from now: %v\n", err)
+		logger.Error("reading daemon state failed", "error", err)
+	}
+	d.jobs = jobs
+	d.load(config)
+
+	if config.StatusListen != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/status", d.serveStatus)
+		go func() {
+			if err := http.ListenAndServe(config.StatusListen, mux); err != nil {
+				fmt.Printf("Status endpoint stopped: %v\n", err)
+				logger.Error("status endpoint stopped", "listen", config.StatusListen, "error", err)
+			}
+		}()
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	fmt.Printf("Resticara daemon started with %d jobs\n", len(d.jobs))
+	logger.Info("daemon started", "jobs", len(d.jobs))
+	// Jobs run in the background so signals are handled during a run: a
+	// reload waits for the run to finish, a stop is passed on to the running
+	// commands and the daemon exits once the state of the job is saved.
+	var done chan struct{}
+	reload := false
+	for {
+		// Without any upcoming job the daemon only waits for signals.
+		var wake <-chan time.Time
+		var timer *time.Timer
+		if next, ok := d.nextDue(); ok && done == nil {
+			timer = time.NewTimer(time.Until(next))
+			wake = timer.C
+		}
+
+		select {
+		case sig := <-sigs:
+			if timer != nil {
+				timer.Stop()
+			}
+			switch {
+			case sig == syscall.SIGHUP && done != nil:
+				reload = true
+				continue
+			case sig == syscall.SIGHUP:
+				d.reload()
+				continue
+			case done != nil:
+				d.mu.Lock()
+				stopping := d.stopping
+				d.stopping = true
+				d.mu.Unlock()
+				if !stopping {
+					fmt.Println("Stopping the running job")
+					logger.Info("stopping running job", "signal", sig.String())
+					signalCommands(sig)
+					continue
+				}
+			}
+			fmt.Println("Resticara daemon stopped")
+			logger.Info("daemon stopped")
+			return nil
+		case <-done:
+			done = nil
+			d.mu.Lock()
+			stopping := d.stopping
+			d.mu.Unlock()
+			if stopping {
+				fmt.Println("Resticara daemon stopped")
+				logger.Info("daemon stopped")
+				return nil
+			}
+			if reload {
+				reload = false
+				d.reload()
+			}
+		case <-wake:
+			done = make(chan struct{})
+			go func(done chan struct{}) {
+				defer close(done)
+				d.runDue()
+			}(done)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// DirJob backs up one or more directories, from [dir:NAME] sections.
+type DirJob struct {
+	JobSettings
+	Directories       []string
+	Exclude           []string
+	ExcludeFile       []string
+	IExclude          []string
+	ExcludeCaches     bool
+	ExcludeIfPresent  []string
+	OneFileSystem     bool
+	ExcludeLargerThan string
+	FilesFrom         []string
+	ReadConcurrency   int
+	RequireMountpoint []string
+	RequireFiles      []string
+	MinFiles          int
+	Snapshot          string
+	SnapshotSize      string
+
+	settings map[string]string
+}
+
+func init() {
+	registerJobType("dir", jobType{
+		required: []string{"bucket", "retention_daily", "retention_weekly", "retention_monthly"},
+		optional: []string{"directory", "exclude", "exclude_file", "iexclude", "exclude_caches", "exclude_if_present",
+			"one_file_system", "exclude_larger_than", "files_from", "read_concurrency",
+			"require_mountpoint", "require_files", "min_files", "snapshot", "snapshot_size"},
+		new: func(common JobSettings, settings map[string]string) Job {
+			job := &DirJob{
+				JobSettings:       common,
+				Directories:       directoryList(settings["directory"]),
+				Exclude:           listValue(settings["exclude"]),
+				ExcludeFile:       listValue(settings["exclude_file"]),
+				IExclude:          listValue(settings["iexclude"]),
+				ExcludeIfPresent:  listValue(settings["exclude_if_present"]),
+				ExcludeLargerThan: strings.TrimSpace(settings["exclude_larger_than"]),
+				FilesFrom:         listValue(settings["files_from"]),
+				RequireFiles:      listValue(settings["require_files"]),
+				Snapshot:          strings.TrimSpace(settings["snapshot"]),
+				SnapshotSize:      strings.TrimSpace(settings["snapshot_size"]),
+				settings:          settings,
+			}
+			// invalid values are reported by Validate
+			job.ExcludeCaches, _ = parseBool(settings["exclude_caches"])
+			job.OneFileSystem, _ = parseBool(settings["one_file_system"])
+			job.ReadConcurrency, _ = strconv.Atoi(settings["read_concurrency"])
+			job.MinFiles, _ = strconv.Atoi(settings["min_files"])
+			// require_mountpoint = true checks the directories themselves
+			if val := settings["require_mountpoint"]; val != "" {
+				if b, err := parseBool(val); err != nil {
+					job.RequireMountpoint = listValue(val)
+				} else if b {
+					job.RequireMountpoint = job.Directories
+				}
+			}
+			if job.SnapshotSize == "" {
+				job.SnapshotSize = "1G"
+			}
+			return job
+		},
+	})
+}
+
+// directoryList splits the directory key. INI values may also separate
+// the directories with whitespace, as before lists were comma separated, so
+// paths with spaces have to be written in a YAML or TOML list.
+func directoryList(value string) []string {
+	if strings.Contains(value, listSeparator) {
+		return listValue(value)
+	}
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+}
+
+var byteSizeRe = regexp.MustCompile(`^[0-9]+[bkmgtBKMGT]?$`)
+
+func (j *DirJob) Settings() *JobSettings {
+	return &j.JobSettings
+}
+
+func (j *DirJob) Validate() []settingError {
+	var errs []settingError
+	if len(j.Directories) == 0 && len(j.FilesFrom) == 0 {
+		if strings.TrimSpace(j.settings["directory"]) == "" {
+			errs = append(errs, settingError{j.Key, "directory", errMissing})
+		} else {
+			errs = append(errs, settingError{j.Key, "directory", fmt.Errorf("must list at least one directory")})
+		}
+	}
+	for _, key := range []string{"exclude_caches", "one_file_system"} {
+		if val, ok := j.settings[key]; ok {
+			if _, err := parseBool(val); err != nil {
+				errs = append(errs, settingError{j.Key, key, fmt.Errorf("must be a boolean")})
+			}
+		}
+	}
+	if val, ok := j.settings["read_concurrency"]; ok {
+		if n, err := strconv.Atoi(val); err != nil || n < 1 {
+			errs = append(errs, settingError{j.Key, "read_concurrency", fmt.Errorf("must be a positive integer")})
+		}
+	}
+	if val, ok := j.settings["min_files"]; ok {
+		if n, err := strconv.Atoi(val); err != nil || n < 1 {
+			errs = append(errs, settingError{j.Key, "min_files", fmt.Errorf("must be a positive integer")})
+		} else if len(j.Directories) == 0 {
+			errs = append(errs, settingError{j.Key, "min_files", fmt.Errorf("requires 'directory'")})
+		}
+	}
+	if _, ok := j.settings["exclude_larger_than"]; ok && !byteSizeRe.MatchString(j.ExcludeLargerThan) {
+		errs = append(errs, settingError{j.Key, "exclude_larger_than", fmt.Errorf("must be a size such as 500M or 2G")})
+	}
+	if j.Snapshot != "" {
+		switch {
+		case snapshotProviders[j.Snapshot] == nil:
+			errs = append(errs, settingError{j.Key, "snapshot", fmt.Errorf("unknown snapshot type %q, expected lvm, btrfs or zfs", j.Snapshot)})
+		case len(j.FilesFrom) > 0 || len(j.Directories) == 0:
+			errs = append(errs, settingError{j.Key, "snapshot", fmt.Errorf("requires 'directory' and cannot be combined with 'files_from'")})
+		}
+	}
+	if _, ok := j.settings["snapshot_size"]; ok {
+		if !byteSizeRe.MatchString(j.SnapshotSize) {
+			errs = append(errs, settingError{j.Key, "snapshot_size", fmt.Errorf("must be a size such as 500M or 2G")})
+		} else if j.Snapshot != "lvm" {
+			errs = append(errs, settingError{j.Key, "snapshot_size", fmt.Errorf("is only used with 'snapshot = lvm'")})
+		}
+	}
+	return errs
+}
+
+// Preflight makes sure the directories hold the data to back up, so an
+// unmounted file system is not backed up as an empty directory.
+func (j *DirJob) Preflight() error {
+	for _, path := range j.RequireMountpoint {
+		mounted, err := isMountpoint(path)
+		if err != nil {
+			return fmt.Errorf("require_mountpoint: %v", err)
+		}
+		if !mounted {
+			return fmt.Errorf("require_mountpoint: %s is not a mount point", path)
+		}
+	}
+	for _, file := range j.RequireFiles {
+		paths := []string{file}
+		if !filepath.IsAbs(file) {
+			// relative sentinels have to exist in every directory
+			paths = nil
+			for _, dir := range j.Directories {
+				paths = append(paths, filepath.Join(dir, file))
+			}
+		}
+		for _, path := range paths {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				return fmt.Errorf("require_files: %s does not exist", path)
+			} else if err != nil {
+				return fmt.Errorf("require_files: %v", err)
+			}
+		}
+	}
+	if j.MinFiles > 0 {
+		count, err := countFiles(j.Directories, j.MinFiles)
+		if err != nil {
+			return fmt.Errorf("min_files: %v", err)
+		}
+		if count < j.MinFiles {
+			return fmt.Errorf("min_files: found %d files, expected at least %d", count, j.MinFiles)
+		}
+	}
+	if j.Snapshot != "" {
+		if os.Geteuid() != 0 {
+			return fmt.Errorf("snapshot: creating %s snapshots requires root", j.Snapshot)
+		}
+		for _, tool := range append([]string{"unshare"}, snapshotProviders[j.Snapshot](j).Tools()...) {
+			if _, err := exec.LookPath(tool); err != nil {
+				return fmt.Errorf("snapshot: %s not found", tool)
+			}
+		}
+	}
+	return nil
+}
+
+// Prepare takes the snapshots of the directories and returns the backup
+// pipeline reading from them. The returned cleanup removes the snapshots
+// and has to be called even if Prepare fails.
+func (j *DirJob) Prepare() (pipeline, func() error, error) {
+	backup := j.BackupPipeline()
+	if j.Snapshot == "" {
+		return backup, func() error { return nil }, nil
+	}
+	label := sanitizeName(j.Name) + "-" + time.Now().Format("20060102150405")
+	binds, cleanup, err := snapshotDirectories(snapshotProviders[j.Snapshot](j), findMount, j.Directories, label)
+	if err != nil {
+		return backup, cleanup, err
+	}
+	if j.Snapshot == "btrfs" {
+		// the snapshot is visible in the mount point while restic runs
+		backup.Restic = append(backup.Restic, "--exclude", btrfsSnapshotPrefix+label)
+	}
+	backup.Restic = bindSnapshots(binds, backup.Restic)
+	return backup, cleanup, nil
+}
+
+// BackupPipeline maps the settings to the options of restic backup.
+func (j *DirJob) BackupPipeline() pipeline {
+	args := j.backupArgs()
+	for _, pattern := range j.Exclude {
+		args = append(args, "--exclude", pattern)
+	}
+	for _, pattern := range j.IExclude {
+		args = append(args, "--iexclude", pattern)
+	}
+	for _, file := range j.ExcludeFile {
+		args = append(args, "--exclude-file", file)
+	}
+	if j.ExcludeCaches {
+		args = append(args, "--exclude-caches")
+	}
+	for _, file := range j.ExcludeIfPresent {
+		args = append(args, "--exclude-if-present", file)
+	}
+	if j.OneFileSystem {
+		args = append(args, "--one-file-system")
+	}
+	if j.ExcludeLargerThan != "" {
+		args = append(args, "--exclude-larger-than", j.ExcludeLargerThan)
+	}
+	for _, file := range j.FilesFrom {
+		args = append(args, "--files-from", file)
+	}
+	if j.ReadConcurrency > 0 {
+		args = append(args, "--read-concurrency", strconv.Itoa(j.ReadConcurrency))
+	}
+	return pipeline{Restic: append(args, j.Directories...)}
+}
+
+func (j *DirJob) ReadPaths() []string {
+	return j.Directories
+}
+
+func (j *DirJob) Describe() string {
+	if len(j.Directories) == 0 {
+		return "files listed in " + strings.Join(j.FilesFrom, ", ")
+	}
+	if j.Snapshot != "" {
+		return "directories " + strings.Join(j.Directories, ", ") + " from " + j.Snapshot + " snapshots"
+	}
+	return "directories " + strings.Join(j.Directories, ", ")
+}
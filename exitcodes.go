@@ -0,0 +1,41 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+// Exit codes of the resticara commands. Lock contention and notification
+// failures are not treated as failed runs by the generated systemd units,
+// see SuccessExitStatus in renderUnits.
+const (
+	exitOK            = 0
+	exitFailure       = 1 // every job failed, or the command could not run
+	exitConfigError   = 2 // invalid config, template or command line
+	exitPartialFailed = 3 // some jobs failed, others succeeded
+	exitNotifyFailed  = 4 // the jobs succeeded but a notification was not sent
+	exitLocked        = 5 // the job is already running
+)
+
+// jobsExitCode combines the results of several jobs into one exit code.
+func jobsExitCode(failed, succeeded, locked int) int {
+	switch {
+	case failed > 0 && succeeded == 0:
+		return exitFailure
+	case failed > 0:
+		return exitPartialFailed
+	case locked > 0:
+		return exitLocked
+	}
+	return exitOK
+}
@@ -0,0 +1,105 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+const templatePrefix = "template:"
+
+// inheritedTemplates returns the templates listed in the inherits key of a
+// section, in the order they are applied.
+func inheritedTemplates(section *ini.Section) []string {
+	return listValue(section.Key("inherits").String())
+}
+
+// mergeJobSettings returns the effective settings of every job section.
+// Values are taken from [defaults], then from the inherited templates in
+// order, then from the section itself, each overriding the previous ones.
+// origins records the section each value was taken from.
+func mergeJobSettings(cfg *ini.File) (map[string]map[string]string, map[string]map[string]string, []settingError) {
+	settings := make(map[string]map[string]string)
+	origins := make(map[string]map[string]string)
+	var errs []settingError
+
+	// resolve merges a template or job section on top of its templates.
+	var resolve func(section *ini.Section, chain []string) (map[string]string, map[string]string, error)
+	resolve = func(section *ini.Section, chain []string) (map[string]string, map[string]string, error) {
+		values := make(map[string]string)
+		from := make(map[string]string)
+		for _, name := range inheritedTemplates(section) {
+			for _, seen := range chain {
+				if seen == templatePrefix+name {
+					return nil, nil, fmt.Errorf("inheritance cycle %s -> %s", strings.Join(chain, " -> "), templatePrefix+name)
+				}
+			}
+			parent, err := cfg.GetSection(templatePrefix + name)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unknown template '%s'", name)
+			}
+			parentValues, parentFrom, err := resolve(parent, append(chain, parent.Name()))
+			if err != nil {
+				return nil, nil, err
+			}
+			for key, value := range parentValues {
+				values[key] = value
+				from[key] = parentFrom[key]
+			}
+		}
+		for key, value := range section.KeysHash() {
+			if key == "inherits" {
+				continue
+			}
+			values[key] = value
+			from[key] = section.Name()
+		}
+		return values, from, nil
+	}
+
+	var defaults map[string]string
+	if section, err := cfg.GetSection("defaults"); err == nil {
+		defaults = section.KeysHash()
+	}
+
+	for _, section := range cfg.Sections() {
+		name := section.Name()
+		if !strings.Contains(name, ":") || strings.HasPrefix(name, templatePrefix) || strings.HasPrefix(name, repositoryPrefix) {
+			continue
+		}
+		values := make(map[string]string)
+		from := make(map[string]string)
+		for key, value := range defaults {
+			values[key] = value
+			from[key] = "defaults"
+		}
+		merged, mergedFrom, err := resolve(section, []string{name})
+		if err != nil {
+			errs = append(errs, settingError{name, "inherits", err})
+			continue
+		}
+		for key, value := range merged {
+			values[key] = value
+			from[key] = mergedFrom[key]
+		}
+		settings[name] = values
+		origins[name] = from
+	}
+	return settings, origins, errs
+}
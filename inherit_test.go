@@ -0,0 +1,77 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInheritsYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := `smtp:
+  enabled: false
+template:
+  retention:
+    bucket: /srv/repo
+    retention_daily: 7
+    retention_weekly: 4
+    retention_monthly: 6
+  web:
+    exclude: ["*.log"]
+    tags: [web]
+dir:
+  www:
+    inherits: [retention, web]
+    directory: [/var/www]
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := readConfig(path)
+	if err != nil {
+		t.Fatalf("readConfig(): %v", err)
+	}
+	job, ok := config.Jobs["dir:www"].(*DirJob)
+	if !ok {
+		t.Fatalf("jobs = %v, want dir:www", config.Jobs)
+	}
+	if job.Bucket != "/srv/repo" || job.RetentionDaily != 7 {
+		t.Errorf("bucket %q, retention_daily %d, want the retention template", job.Bucket, job.RetentionDaily)
+	}
+	if !reflect.DeepEqual(job.Tags, []string{"web"}) || !reflect.DeepEqual(job.Exclude, []string{"*.log"}) {
+		t.Errorf("tags %q, exclude %q, want the web template", job.Tags, job.Exclude)
+	}
+
+	converted, err := convertConfig(path, "yaml")
+	if err != nil {
+		t.Fatalf("convertConfig(): %v", err)
+	}
+	if !strings.Contains(string(converted), "inherits:\n      - retention\n      - web\n") {
+		t.Errorf("convertConfig() does not write inherits as a list:\n%s", converted)
+	}
+	converted, err = convertConfig(path, "ini")
+	if err != nil {
+		t.Fatalf("convertConfig(): %v", err)
+	}
+	if !strings.Contains(string(converted), "inherits = retention, web\n") {
+		t.Errorf("convertConfig() does not write inherits as a comma separated list:\n%s", converted)
+	}
+}
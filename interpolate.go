@@ -0,0 +1,102 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+var referenceRe = regexp.MustCompile(`\$\{(ENV|FILE|CRED|CMD):([^}]*)\}`)
+
+// resolveReference returns the value of one ${TYPE:arg} reference.
+func resolveReference(kind, arg string) (string, error) {
+	switch kind {
+	case "ENV":
+		val, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", arg)
+		}
+		return val, nil
+	case "FILE":
+		content, err := os.ReadFile(arg)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", arg, err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	case "CRED":
+		// systemd credentials passed with LoadCredential= or SetCredential=
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			return "", fmt.Errorf("credential %s requested but CREDENTIALS_DIRECTORY is not set", arg)
+		}
+		return resolveReference("FILE", filepath.Join(dir, arg))
+	case "CMD":
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", arg)
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			if msg := lastLine(stderr.String()); msg != "" {
+				return "", fmt.Errorf("command %q failed: %v: %s", arg, err, msg)
+			}
+			return "", fmt.Errorf("command %q failed: %v", arg, err)
+		}
+		return strings.TrimRight(stdout.String(), "\r\n"), nil
+	}
+	return "", fmt.Errorf("unknown reference type %s", kind)
+}
+
+// interpolate replaces the ${ENV:NAME}, ${FILE:/path}, ${CRED:name} and
+// ${CMD:command} references in value.
+func interpolate(value string) (string, error) {
+	var firstErr error
+	result := referenceRe.ReplaceAllStringFunc(value, func(ref string) string {
+		m := referenceRe.FindStringSubmatch(ref)
+		val, err := resolveReference(m[1], m[2])
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return val
+	})
+	return result, firstErr
+}
+
+// interpolateConfig resolves the references in every value of cfg in place.
+func interpolateConfig(cfg *ini.File) []settingError {
+	var errs []settingError
+	for _, section := range cfg.Sections() {
+		for _, key := range section.Keys() {
+			if !strings.Contains(key.Value(), "${") {
+				continue
+			}
+			val, err := interpolate(key.Value())
+			if err != nil {
+				errs = append(errs, settingError{section.Name(), key.Name(), err})
+				continue
+			}
+			key.SetValue(val)
+		}
+	}
+	return errs
+}
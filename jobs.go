@@ -0,0 +1,265 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Job is a configured backup job. Every section type registers its own
+// implementation in jobTypes, keyed by the section prefix.
+type Job interface {
+	// Settings returns the settings shared by all job types.
+	Settings() *JobSettings
+	// Validate checks the settings specific to the job type.
+	Validate() []settingError
+	// Preflight checks that the source is ready to be backed up.
+	Preflight() error
+	// BackupPipeline returns the command line which creates the snapshot.
+	BackupPipeline() pipeline
+	// ReadPaths returns the paths the backup reads, for sandboxing.
+	ReadPaths() []string
+	// Describe returns a short description of what the job backs up.
+	Describe() string
+}
+
+// preparedJob is implemented by jobs which have to set up their source,
+// such as a file system snapshot, right before the backup.
+type preparedJob interface {
+	// Prepare returns the backup pipeline to run and a cleanup function,
+	// which is called after the backup and also when Prepare fails.
+	Prepare() (pipeline, func() error, error)
+}
+
+// restorableJob is implemented by jobs whose snapshots hold a single dump,
+// which the restore command streams back into a program.
+type restorableJob interface {
+	// RestoreCommand returns the path of the dump in the snapshot and the
+	// command reading it from its standard input, with extra arguments.
+	RestoreCommand(extra []string) (string, []string)
+}
+
+// JobSettings holds the settings every job section has, already parsed.
+type JobSettings struct {
+	Key      string
+	Type     string
+	Name     string
+	Bucket   string
+	Password string
+	Tags     []string
+	Host     string
+	GroupBy  string
+	CopyTo   []string
+	// growth alerts, see growthAlerts
+	AlertMinAdded      *int64
+	AlertMaxAdded      *int64
+	AlertChangePercent int
+	AlertHistory       int
+	AlertFail          bool
+	RetentionDaily     int
+	RetentionWeekly    int
+	RetentionMonthly   int
+	RetentionPrune     *int
+	Schedule           string
+	PruneSchedule      string
+	RandomizedDelay    string
+	Accuracy           string
+	Hardening          *bool
+	Nice               *int
+	IOSchedulingClass  string
+	CPUQuota           string
+	MemoryMax          string
+}
+
+// jobType describes a section type: its keys, the required ones first, and
+// how to build the job from the merged settings of a section.
+type jobType struct {
+	required, optional []string
+	new                func(common JobSettings, settings map[string]string) Job
+}
+
+var jobTypes = map[string]jobType{}
+
+func registerJobType(name string, t jobType) {
+	jobTypes[name] = t
+}
+
+var errMissing = errors.New("missing required key")
+
+// newJob builds the job of a section from its merged settings. All problems
+// are returned, the job is only usable when there are none.
+func newJob(commandKey string, settings map[string]string) (Job, []settingError) {
+	commandType, name, _ := strings.Cut(commandKey, ":")
+	t, ok := jobTypes[commandType]
+	if !ok {
+		var types []string
+		for name := range jobTypes {
+			types = append(types, name)
+		}
+		sort.Strings(types)
+		return nil, []settingError{{commandKey, "", fmt.Errorf("unknown job type '%s', expected one of %s", commandType, strings.Join(types, ", "))}}
+	}
+
+	var errs []settingError
+	for _, key := range t.required {
+		if strings.TrimSpace(settings[key]) == "" {
+			errs = append(errs, settingError{commandKey, key, errMissing})
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if errs = checkJobSettings(commandKey, settings); len(errs) > 0 {
+		return nil, errs
+	}
+
+	common := JobSettings{
+		Key:               commandKey,
+		Type:              commandType,
+		Name:              name,
+		Bucket:            settings["bucket"],
+		Password:          settings["password"],
+		Tags:              listValue(settings["tags"]),
+		Host:              strings.TrimSpace(settings["host"]),
+		GroupBy:           "host,tags",
+		CopyTo:            listValue(settings["copy_to"]),
+		AlertHistory:      10,
+		AlertFail:         settings["alert_level"] == "failed",
+		Schedule:          settings["schedule"],
+		PruneSchedule:     settings["prune_schedule"],
+		RandomizedDelay:   settings["randomized_delay"],
+		Accuracy:          settings["accuracy"],
+		IOSchedulingClass: settings["io_scheduling_class"],
+		CPUQuota:          settings["cpu_quota"],
+		MemoryMax:         settings["memory_max"],
+	}
+	if val, ok := settings["group_by"]; ok {
+		common.GroupBy = strings.Join(listValue(val), ",")
+	}
+	if common.Schedule == "" {
+		common.Schedule = "daily"
+	}
+	// the values have been checked by checkJobSettings
+	common.RetentionDaily, _ = strconv.Atoi(settings["retention_daily"])
+	common.RetentionWeekly, _ = strconv.Atoi(settings["retention_weekly"])
+	common.RetentionMonthly, _ = strconv.Atoi(settings["retention_monthly"])
+	if val, ok := settings["retention_prune"]; ok {
+		n, _ := strconv.Atoi(val)
+		common.RetentionPrune = &n
+	}
+	if val, ok := settings["systemd_hardening"]; ok {
+		b, _ := parseBool(val)
+		common.Hardening = &b
+	}
+	if val, ok := settings["nice"]; ok {
+		n, _ := strconv.Atoi(val)
+		common.Nice = &n
+	}
+	if val, ok := settings["alert_min_added"]; ok {
+		n, _ := parseByteSize(val)
+		common.AlertMinAdded = &n
+	}
+	if val, ok := settings["alert_max_added"]; ok {
+		n, _ := parseByteSize(val)
+		common.AlertMaxAdded = &n
+	}
+	if val, ok := settings["alert_change_percent"]; ok {
+		common.AlertChangePercent, _ = strconv.Atoi(val)
+	}
+	if val, ok := settings["alert_history"]; ok {
+		common.AlertHistory, _ = strconv.Atoi(val)
+	}
+
+	job := t.new(common, settings)
+	if errs := job.Validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	return job, nil
+}
+
+// parseBool accepts the same spellings as the INI parser, such as yes and
+// on, so booleans read the same in every config format.
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "t", "true", "y", "yes", "on":
+		return true, nil
+	case "0", "f", "false", "n", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", value)
+}
+
+// snapshotTags returns the tags of the job's snapshots: resticara, the job
+// key and the configured tags.
+func (s *JobSettings) snapshotTags() []string {
+	return append([]string{"resticara", s.Key}, s.Tags...)
+}
+
+// backupArgs returns the restic backup command line up to the options of
+// the job type.
+func (s *JobSettings) backupArgs() []string {
+	args := []string{"restic", "-r", s.Bucket, "backup"}
+	for _, tag := range s.snapshotTags() {
+		args = append(args, "--tag", tag)
+	}
+	if s.Host != "" {
+		args = append(args, "--host", s.Host)
+	}
+	return args
+}
+
+// snapshotHost returns the host recorded in the job's snapshots.
+func (s *JobSettings) snapshotHost() string {
+	if s.Host != "" {
+		return s.Host
+	}
+	// restic backup records the hostname unless --host is given
+	host, _ := os.Hostname()
+	return host
+}
+
+// ForgetPipeline returns the restic forget command applying the retention
+// policy of the job. It only selects the snapshots of this job on this host,
+// so jobs sharing a repository do not remove each other's snapshots.
+func (s *JobSettings) ForgetPipeline() pipeline {
+	return s.forgetPipeline(s.Bucket, s.RetentionDaily, s.RetentionWeekly, s.RetentionMonthly)
+}
+
+func (s *JobSettings) forgetPipeline(bucket string, daily, weekly, monthly int) pipeline {
+	args := []string{"restic", "-r", bucket, "forget", "--tag", "resticara," + s.Key}
+	if host := s.snapshotHost(); host != "" {
+		args = append(args, "--host", host)
+	}
+	return pipeline{Restic: append(args, "--group-by", s.GroupBy,
+		"--keep-daily", strconv.Itoa(daily),
+		"--keep-weekly", strconv.Itoa(weekly),
+		"--keep-monthly", strconv.Itoa(monthly))}
+}
+
+// sortedJobKeys returns the keys of all configured jobs in name order.
+func sortedJobKeys(config Config) []string {
+	var commandKeys []string
+	for k := range config.Jobs {
+		commandKeys = append(commandKeys, k)
+	}
+	sort.Strings(commandKeys)
+	return commandKeys
+}
@@ -0,0 +1,195 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+)
+
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalFields maps well known record keys to journal fields, so entries
+// can be filtered with e.g. journalctl RESTICARA_JOB=dir:website. Other keys
+// are exported as RESTICARA_<KEY>.
+var journalFields = map[string]string{
+	"job":         "RESTICARA_JOB",
+	"repo":        "RESTICARA_REPO",
+	"phase":       "RESTICARA_PHASE",
+	"snapshot_id": "RESTICARA_SNAPSHOT",
+}
+
+// journaldHandler writes records to the native journal protocol, see
+// systemd.journal-fields(7) and sd_journal_sendv(3).
+type journaldHandler struct {
+	conn   *net.UnixConn
+	level  slog.Leveler
+	attrs  []slog.Attr
+	groups []string
+	text   *priorityHandler
+}
+
+func newJournaldHandler(level slog.Leveler) (*journaldHandler, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	h := &journaldHandler{conn: conn, level: level}
+	// the MESSAGE field carries the same key=value text as syslog, so the
+	// details stay visible in plain journalctl output
+	h.text = newPriorityHandler(level, nil)
+	return h, nil
+}
+
+func (h *journaldHandler) Close() error {
+	return h.conn.Close()
+}
+
+func (h *journaldHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *journaldHandler) Handle(ctx context.Context, r slog.Record) error {
+	var message string
+	text := *h.text
+	text.emit = func(_ slog.Level, msg string) error {
+		message = msg
+		return nil
+	}
+	if err := text.Handle(ctx, r); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", message)
+	writeJournalField(&buf, "PRIORITY", fmt.Sprintf("%d", syslogPriority(r.Level)))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", "resticara")
+
+	prefix := strings.Join(h.groups, "_")
+	for _, a := range h.attrs {
+		writeJournalAttr(&buf, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeJournalAttr(&buf, prefix, a)
+		return true
+	})
+
+	return h.send(buf.Bytes())
+}
+
+// send writes one entry as a datagram. Entries larger than the socket
+// buffer are passed as an unlinked temporary file instead.
+func (h *journaldHandler) send(entry []byte) error {
+	_, err := h.conn.Write(entry)
+	if err == nil || !errors.Is(err, syscall.EMSGSIZE) && !errors.Is(err, syscall.ENOBUFS) {
+		return err
+	}
+
+	file, err := os.CreateTemp("/dev/shm", "resticara-journal-")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := os.Remove(file.Name()); err != nil {
+		return err
+	}
+	if _, err := file.Write(entry); err != nil {
+		return err
+	}
+	_, _, err = h.conn.WriteMsgUnix(nil, syscall.UnixRights(int(file.Fd())), nil)
+	return err
+}
+
+func (h *journaldHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append([]slog.Attr{}, h.attrs...)
+	prefix := strings.Join(h.groups, "_")
+	for _, a := range attrs {
+		if prefix != "" {
+			a.Key = prefix + "_" + a.Key
+		}
+		clone.attrs = append(clone.attrs, a)
+	}
+	clone.text = h.text.WithAttrs(attrs).(*priorityHandler)
+	return &clone
+}
+
+func (h *journaldHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	clone.groups = append(append([]string{}, h.groups...), name)
+	clone.text = h.text.WithGroup(name).(*priorityHandler)
+	return &clone
+}
+
+func writeJournalAttr(buf *bytes.Buffer, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	key := a.Key
+	if prefix != "" {
+		key = prefix + "_" + key
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			writeJournalAttr(buf, key, ga)
+		}
+		return
+	}
+	if key == "" {
+		return
+	}
+	field, ok := journalFields[key]
+	if !ok {
+		field = "RESTICARA_" + journalFieldName(key)
+	}
+	writeJournalField(buf, field, a.Value.String())
+}
+
+// journalFieldName converts a record key into a valid journal field name:
+// upper case letters, digits and underscores only.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	if len(name) > 54 {
+		name = name[:54]
+	}
+	return name
+}
+
+// writeJournalField serializes a field, using the length prefixed binary
+// form for values which span several lines.
+func writeJournalField(buf *bytes.Buffer, field, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(buf, "%s=%s\n", field, value)
+		return
+	}
+	buf.WriteString(field + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
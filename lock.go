@@ -0,0 +1,65 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var errLocked = errors.New("already running")
+
+// lockDir returns the directory for the job lock files, /run/resticara for
+// root and the runtime directory of the user otherwise. These are the paths
+// of RuntimeDirectory=resticara, which stays writable in hardened units.
+func lockDir() string {
+	if dir := os.Getenv("RUNTIME_DIRECTORY"); dir != "" {
+		return strings.Split(dir, ":")[0]
+	}
+	if os.Geteuid() == 0 {
+		return "/run/resticara"
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "resticara")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("resticara-%d", os.Geteuid()))
+}
+
+// acquireLock takes an exclusive lock named name without waiting. It returns
+// errLocked when another resticara process holds it. The lock is released
+// by closing the returned file.
+func acquireLock(name string) (*os.File, error) {
+	dir := lockDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %v", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, name+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errLocked
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", file.Name(), err)
+	}
+	return file, nil
+}
@@ -0,0 +1,204 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var logLevels = map[string]slog.Level{
+	"debug":   slog.LevelDebug,
+	"info":    slog.LevelInfo,
+	"warn":    slog.LevelWarn,
+	"warning": slog.LevelWarn,
+	"error":   slog.LevelError,
+}
+
+// priorityHandler formats records as "message key=value ..." text and hands
+// them to emit together with the level, for sinks which carry their own
+// priority such as syslog.
+type priorityHandler struct {
+	level slog.Leveler
+	emit  func(level slog.Level, msg string) error
+	wrap  func(slog.Handler) slog.Handler
+}
+
+func newPriorityHandler(level slog.Leveler, emit func(slog.Level, string) error) *priorityHandler {
+	return &priorityHandler{level: level, emit: emit, wrap: func(h slog.Handler) slog.Handler { return h }}
+}
+
+func (h *priorityHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *priorityHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	text := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// the sink records the time and the priority itself, and the
+			// message is written unquoted in front of the attributes
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey || a.Key == slog.MessageKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	if err := h.wrap(text).Handle(ctx, r); err != nil {
+		return err
+	}
+	return h.emit(r.Level, strings.TrimSpace(r.Message+" "+buf.String()))
+}
+
+func (h *priorityHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	wrap := h.wrap
+	return &priorityHandler{level: h.level, emit: h.emit, wrap: func(inner slog.Handler) slog.Handler {
+		return wrap(inner).WithAttrs(attrs)
+	}}
+}
+
+func (h *priorityHandler) WithGroup(name string) slog.Handler {
+	wrap := h.wrap
+	return &priorityHandler{level: h.level, emit: h.emit, wrap: func(inner slog.Handler) slog.Handler {
+		return wrap(inner).WithGroup(name)
+	}}
+}
+
+// syslogPriority maps slog levels to syslog(3) priorities.
+func syslogPriority(level slog.Level) syslog.Priority {
+	switch {
+	case level >= slog.LevelError:
+		return syslog.LOG_ERR
+	case level >= slog.LevelWarn:
+		return syslog.LOG_WARNING
+	case level >= slog.LevelInfo:
+		return syslog.LOG_NOTICE
+	default:
+		return syslog.LOG_DEBUG
+	}
+}
+
+// newLogger creates the logger for the sink configured in [logging]. The
+// returned closer releases the underlying writer.
+func newLogger(config Config) (*slog.Logger, io.Closer, error) {
+	level, ok := logLevels[strings.ToLower(config.LogLevel)]
+	if !ok {
+		level = slog.LevelInfo
+	}
+	opts := &slog.HandlerOptions{Level: level}
+
+	sink := config.LogSink
+	if sink == "" {
+		// systemd sets JOURNAL_STREAM when stdout or stderr is connected
+		// to the journal, as in the units written by gentimer
+		sink = "syslog"
+		if os.Getenv("JOURNAL_STREAM") != "" {
+			sink = "journald"
+		}
+	}
+
+	switch sink {
+	case "syslog":
+		writer, err := syslog.New(syslog.LOG_NOTICE, "resticara")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to initialize syslog writer: %v", err)
+		}
+		handler := newPriorityHandler(level, func(l slog.Level, msg string) error {
+			switch syslogPriority(l) {
+			case syslog.LOG_ERR:
+				return writer.Err(msg)
+			case syslog.LOG_WARNING:
+				return writer.Warning(msg)
+			case syslog.LOG_NOTICE:
+				return writer.Notice(msg)
+			default:
+				return writer.Debug(msg)
+			}
+		})
+		return slog.New(handler), writer, nil
+	case "journald":
+		if handler, err := newJournaldHandler(level); err == nil {
+			return slog.New(handler), handler, nil
+		}
+		// Without the native socket fall back to stderr, which the journal
+		// reads with the sd-daemon(3) "<priority>" line prefix.
+		handler := newPriorityHandler(level, func(l slog.Level, msg string) error {
+			for _, line := range strings.Split(msg, "\n") {
+				if _, err := fmt.Fprintf(os.Stderr, "<%d>%s\n", syslogPriority(l), line); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		return slog.New(handler), io.NopCloser(nil), nil
+	case "stderr":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), io.NopCloser(nil), nil
+	case "json":
+		if config.LogFile == "" {
+			return slog.New(slog.NewJSONHandler(os.Stderr, opts)), io.NopCloser(nil), nil
+		}
+		file, err := os.OpenFile(config.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open log file: %v", err)
+		}
+		return slog.New(slog.NewJSONHandler(file, opts)), file, nil
+	}
+	return nil, nil, fmt.Errorf("unknown log sink %q", config.LogSink)
+}
+
+var snapshotSavedRe = regexp.MustCompile(`snapshot ([0-9a-f]{8,64}) saved`)
+
+// parseSnapshotID extracts the ID of the snapshot created by restic backup.
+func parseSnapshotID(output string) string {
+	if m := snapshotSavedRe.FindStringSubmatch(output); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// logPhase records the result of one restic invocation of a job.
+func logPhase(logger *slog.Logger, job, phase, repo string, duration time.Duration, success bool, stdout, stderr string) {
+	var attrs []any
+	if job != "" {
+		attrs = append(attrs, slog.String("job", job))
+	}
+	attrs = append(attrs, slog.String("phase", phase), slog.String("repo", repo))
+	logger.Debug("command output", append(attrs, slog.String("stdout", strings.TrimSpace(stdout)), slog.String("stderr", strings.TrimSpace(stderr)))...)
+
+	attrs = append(attrs, slog.Duration("duration", duration))
+	if id := parseSnapshotID(stdout); phase == "backup" && id != "" {
+		attrs = append(attrs, slog.String("snapshot_id", id))
+	}
+	if success {
+		logger.Info(phase+" finished", append(attrs, slog.String("status", "success"))...)
+	} else {
+		logger.Error(phase+" failed", append(attrs, slog.String("status", "failed"), slog.String("error", lastLine(stderr)))...)
+	}
+}
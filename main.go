@@ -17,20 +17,20 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"log/syslog"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 
-	"gopkg.in/ini.v1"
 	htmlTemplate "html/template"
 	"resticara/notifiers/email"
 	"resticara/notifiers/matrix"
@@ -38,18 +38,59 @@ import (
 )
 
 type CommandInfo struct {
-	CommandKey   string
-	BackupCmd    string
-	BackupOutput string
-	ForgetCmd    string
-	ForgetOutput string
+	CommandKey     string     `json:"command_key"`
+	Description    string     `json:"description"`
+	BackupCmd      string     `json:"backup_cmd"`
+	BackupOutput   string     `json:"backup_output"`
+	BackupSuccess  bool       `json:"backup_success"`
+	BackupSeconds  float64    `json:"backup_seconds"`
+	BackupError    string     `json:"backup_error,omitempty"`
+	PreflightError string     `json:"preflight_error,omitempty"`
+	CleanupError   string     `json:"cleanup_error,omitempty"`
+	ForgetCmd      string     `json:"forget_cmd"`
+	ForgetOutput   string     `json:"forget_output"`
+	ForgetSuccess  bool       `json:"forget_success"`
+	ForgetSeconds  float64    `json:"forget_seconds"`
+	ForgetError    string     `json:"forget_error,omitempty"`
+	Copies         []CopyInfo `json:"copies,omitempty"`
+	DataAdded      int64      `json:"data_added"`
+	SnapshotSize   int64      `json:"snapshot_size,omitempty"`
+	SnapshotFiles  int64      `json:"snapshot_files,omitempty"`
+	Alerts         []string   `json:"alerts,omitempty"`
+}
+
+// CopyInfo is the result of replicating a snapshot to a copy_to repository.
+type CopyInfo struct {
+	Repository    string  `json:"repository"`
+	CopyCmd       string  `json:"copy_cmd"`
+	CopyOutput    string  `json:"copy_output"`
+	CopySuccess   bool    `json:"copy_success"`
+	CopySeconds   float64 `json:"copy_seconds"`
+	CopyError     string  `json:"copy_error,omitempty"`
+	ForgetCmd     string  `json:"forget_cmd,omitempty"`
+	ForgetOutput  string  `json:"forget_output,omitempty"`
+	ForgetSuccess bool    `json:"forget_success"`
+	ForgetSeconds float64 `json:"forget_seconds"`
+	ForgetError   string  `json:"forget_error,omitempty"`
 }
 
 type MailData struct {
-	HostID        string
-	Date          string
-	Commands      []CommandInfo
-	StatusMessage string
+	HostID        string        `json:"host_id"`
+	Date          string        `json:"date"`
+	Commands      []CommandInfo `json:"commands"`
+	Skipped       []string      `json:"skipped,omitempty"`
+	StatusMessage string        `json:"status_message"`
+	Seconds       float64       `json:"seconds"`
+	Error         string        `json:"error,omitempty"`
+	ExitCode      int           `json:"exit_code"`
+}
+
+type PruneResult struct {
+	Repository string  `json:"repository"`
+	Output     string  `json:"output"`
+	Seconds    float64 `json:"seconds"`
+	Error      string  `json:"error,omitempty"`
+	ExitCode   int     `json:"exit_code"`
 }
 
 type Config struct {
@@ -60,7 +101,15 @@ type Config struct {
 	SMTPServer      string
 	SMTPPort        string
 	HostID          string
+	LogSink         string
+	LogLevel        string
+	LogFile         string
+	Instance        string
 	RetentionPrune  int
+	PruneSchedule   string
+	Hardening       bool
+	NotifyOnFailure bool
+	StatusListen    string
 	SMTPEnabled     bool
 	MatrixEnabled   bool
 	MatrixServer    string
@@ -70,10 +119,11 @@ type Config struct {
 	TelegramEnabled bool
 	TelegramToken   string
 	TelegramChatID  int64
-	Commands        map[string]map[string]string
+	Jobs            map[string]Job
+	Repositories    map[string]Repository
 }
 
-const (
+var (
 	Reset  = "\033[0m"
 	Red    = "\033[31m"
 	Green  = "\033[32m"
@@ -85,16 +135,19 @@ const (
 func readConfig(file string) (Config, error) {
 	var config Config
 
-	cfg, err := ini.Load(file)
+	cfg, src, err := loadConfig(file)
 	if err != nil {
 		return Config{}, err
 	}
+	if errs := interpolateConfig(cfg); len(errs) > 0 {
+		return Config{}, fmt.Errorf("%s: %v", src.locate(errs[0].Section, errs[0].Key), errs[0])
+	}
 
 	config.SMTPEnabled = cfg.Section("smtp").Key("enabled").MustBool(true)
 	config.From = cfg.Section("smtp").Key("from").String()
 	config.Username = cfg.Section("smtp").Key("username").String()
 	config.Pass = cfg.Section("smtp").Key("pass").String()
-	config.To = cfg.Section("smtp").Key("to").String()
+	config.To = strings.Join(listValue(cfg.Section("smtp").Key("to").String()), ",")
 	config.SMTPServer = cfg.Section("smtp").Key("server").String()
 	config.SMTPPort = cfg.Section("smtp").Key("port").String()
 
@@ -108,46 +161,79 @@ func readConfig(file string) (Config, error) {
 	config.TelegramToken = cfg.Section("telegram").Key("bot_token").String()
 	config.TelegramChatID = cfg.Section("telegram").Key("chat_id").MustInt64(0)
 
+	if errs := checkGeneralSettings(cfg); len(errs) > 0 {
+		return Config{}, fmt.Errorf("%s: %v", src.locate(errs[0].Section, errs[0].Key), errs[0])
+	}
 	config.HostID = cfg.Section("general").Key("hostID").String()
+	config.Instance = cfg.Section("general").Key("instance").String()
+	config.LogSink = cfg.Section("logging").Key("sink").String()
+	config.LogLevel = cfg.Section("logging").Key("level").MustString("info")
+	config.LogFile = cfg.Section("logging").Key("file").String()
 	config.RetentionPrune = cfg.Section("general").Key("retention_prune").MustInt(30)
+	config.PruneSchedule = cfg.Section("general").Key("prune_schedule").String()
+	config.Hardening = cfg.Section("general").Key("systemd_hardening").MustBool(false)
+	config.NotifyOnFailure = cfg.Section("general").Key("notify_on_failure").MustBool(false)
+	config.StatusListen = cfg.Section("general").Key("status_listen").String()
+
+	jobSettings, origins, errs := mergeJobSettings(cfg)
+	if len(errs) > 0 {
+		return Config{}, fmt.Errorf("%s: %v", src.locate(errs[0].Section, errs[0].Key), errs[0])
+	}
 
-	config.Commands = make(map[string]map[string]string)
+	config.Jobs = make(map[string]Job)
+	config.Repositories = make(map[string]Repository)
 
 	for _, section := range cfg.Sections() {
-		if section.Name() == "smtp" || section.Name() == "matrix" || section.Name() == "telegram" {
+		name, ok := strings.CutPrefix(section.Name(), repositoryPrefix)
+		if !ok {
 			continue
 		}
+		repo, errs := newRepository(name, section.KeysHash())
+		if len(errs) > 0 {
+			return Config{}, fmt.Errorf("%s: %v", src.locate(errs[0].Section, errs[0].Key), errs[0])
+		}
+		config.Repositories[name] = repo
+	}
 
-		splitName := strings.Split(section.Name(), ":")
-		if len(splitName) < 2 {
+	for _, section := range cfg.Sections() {
+		if section.Name() == "smtp" || section.Name() == "matrix" || section.Name() == "telegram" || section.Name() == "logging" {
 			continue
 		}
 
-		commandType := splitName[0]
-		commandName := splitName[1]
-		commandSettings := make(map[string]string)
-		for key, value := range section.KeysHash() {
-			commandSettings[key] = value
+		splitName := strings.Split(section.Name(), ":")
+		if len(splitName) < 2 || splitName[0] == "template" || splitName[0] == "repository" {
+			continue
 		}
 
-		config.Commands[commandType+":"+commandName] = commandSettings
-	}
-
-	for commandKey, settings := range config.Commands {
-		if _, err := strconv.Atoi(settings["retention_daily"]); err != nil {
-			return Config{}, fmt.Errorf("'retention_daily' for %s must be an integer", commandKey)
-		}
-		if _, err := strconv.Atoi(settings["retention_weekly"]); err != nil {
-			return Config{}, fmt.Errorf("'retention_weekly' for %s must be an integer", commandKey)
+		commandKey := splitName[0] + ":" + splitName[1]
+		job, errs := newJob(commandKey, jobSettings[section.Name()])
+		if len(errs) > 0 {
+			// report inherited values where they are defined
+			section := commandKey
+			if origin, ok := origins[commandKey][errs[0].Key]; ok {
+				section = origin
+			}
+			return Config{}, fmt.Errorf("%s: %v", src.locate(section, errs[0].Key), errs[0])
 		}
-		if _, err := strconv.Atoi(settings["retention_monthly"]); err != nil {
-			return Config{}, fmt.Errorf("'retention_monthly' for %s must be an integer", commandKey)
+		for _, name := range job.Settings().CopyTo {
+			if _, ok := config.Repositories[name]; !ok {
+				err := settingError{commandKey, "copy_to", fmt.Errorf("unknown repository '%s'", name)}
+				section := commandKey
+				if origin, ok := origins[commandKey]["copy_to"]; ok {
+					section = origin
+				}
+				return Config{}, fmt.Errorf("%s: %v", src.locate(section, "copy_to"), err)
+			}
 		}
-		if val, ok := settings["retention_prune"]; ok {
-			if _, err := strconv.Atoi(val); err != nil {
-				return Config{}, fmt.Errorf("'retention_prune' for %s must be an integer", commandKey)
+		if dir, ok := job.(*DirJob); ok && dir.Snapshot != "" && jobHardening(config, job.Settings()) {
+			err := settingError{commandKey, "snapshot", fmt.Errorf("cannot be combined with 'systemd_hardening', which forbids mounting")}
+			section := commandKey
+			if origin, ok := origins[commandKey]["snapshot"]; ok {
+				section = origin
 			}
+			return Config{}, fmt.Errorf("%s: %v", src.locate(section, "snapshot"), err)
 		}
+		config.Jobs[commandKey] = job
 	}
 
 	return config, nil
@@ -168,26 +254,36 @@ func searchForFile(customPath string, defaultLocations []string) string {
 
 func printUsage() {
 	fmt.Println("Usage of resticara:")
-	fmt.Println("  --config=       : Specify a custom config.ini file path")
+	fmt.Println("  --config=       : Specify a custom config file path (.ini, .yaml or .toml)")
 	fmt.Println("  --mail_template=: Specify a custom mail template file path")
+	fmt.Println("  --output=       : Output format, text (default) or json")
 	fmt.Println("  run [command]   : Run backups (all or specific command)")
-	fmt.Println("  prune <all|repository> : Prune restic repositories")
-	fmt.Println("  gentimer        : Generate systemd service and timer files")
+	fmt.Println("  prune <all|repository...> : Prune restic repositories")
+	fmt.Println("  tag-snapshots <all|job...> : Tag the snapshots taken before resticara tagged them")
+	fmt.Println("  restore <job> [snapshot] [-- options] : Restore the dump of a mongodb job")
+	fmt.Println("  daemon          : Stay resident and run the jobs on their schedules")
+	fmt.Println("  gentimer [--user] [--dry-run] [--output-dir=DIR] [--no-activate]")
+	fmt.Println("                  : Generate systemd service and timer files")
+	fmt.Println("  gencron [--dry-run] [--file=FILE] [--user=USER]")
+	fmt.Println("                  : Generate /etc/cron.d/resticara")
+	fmt.Println("  notify-failure [--user] <unit> : Send a failure notification for a systemd unit")
+	fmt.Println("  config validate [--strict] : Check the configuration and report all problems")
+	fmt.Println("  config convert --to=yaml|toml|ini [--output=FILE]")
+	fmt.Println("                  : Print the config file in another format")
 }
 
-func printSummary(mailData MailData, logwriter *syslog.Writer) {
-
-	// Log to syslog
-	logwriter.Notice(fmt.Sprintf("Host ID: %s", mailData.HostID))
-	logwriter.Notice(fmt.Sprintf("Date: %s", mailData.Date))
-	logwriter.Notice(fmt.Sprintf("Status: %s", mailData.StatusMessage))
-
+func printSummary(mailData MailData, logger *slog.Logger) {
+	var jobs []string
 	for _, cmdInfo := range mailData.Commands {
-		logwriter.Notice(fmt.Sprintf("Command Key: %s", cmdInfo.CommandKey))
-		logwriter.Notice(fmt.Sprintf("Backup Command: %s", cmdInfo.BackupCmd))
-		logwriter.Notice(fmt.Sprintf("Backup Output: %s", strings.TrimSpace(cmdInfo.BackupOutput)))
-		logwriter.Notice(fmt.Sprintf("Forget Command: %s", cmdInfo.ForgetCmd))
-		logwriter.Notice(fmt.Sprintf("Forget Output: %s", strings.TrimSpace(cmdInfo.ForgetOutput)))
+		jobs = append(jobs, cmdInfo.CommandKey)
+	}
+	attrs := []any{"host", mailData.HostID, "jobs", strings.Join(jobs, ","), "status", mailData.StatusMessage}
+	if mailData.StatusMessage == "Backup successful" {
+		logger.Info("backup run finished", attrs...)
+	} else if mailData.StatusMessage == "Backup finished with warnings" {
+		logger.Warn("backup run finished", attrs...)
+	} else {
+		logger.Error("backup run finished", attrs...)
 	}
 
 	fmt.Println(Bold + "Backup Summary:" + Reset)
@@ -196,33 +292,75 @@ func printSummary(mailData MailData, logwriter *syslog.Writer) {
 	fmt.Printf(Bold+"Date:"+Reset+" %s\n", mailData.Date)
 	if mailData.StatusMessage == "Backup successful" {
 		fmt.Printf(Bold+"Status:"+Reset+" %s%s%s\n", Green, mailData.StatusMessage, Reset)
+	} else if mailData.StatusMessage == "Backup finished with warnings" {
+		fmt.Printf(Bold+"Status:"+Reset+" %s%s%s\n", Yellow, mailData.StatusMessage, Reset)
 	} else {
 		fmt.Printf(Bold+"Status:"+Reset+" %s%s%s\n", Red, mailData.StatusMessage, Reset)
 	}
 	for _, cmdInfo := range mailData.Commands {
-		fmt.Printf(Bold+"Command Key:"+Reset+" %s\n", cmdInfo.CommandKey)
+		fmt.Printf(Bold+"Command Key:"+Reset+" %s (%s)\n", cmdInfo.CommandKey, cmdInfo.Description)
+		if cmdInfo.PreflightError != "" {
+			fmt.Printf("  "+Bold+"Preflight Failed:"+Reset+" %s%s%s\n", Red, cmdInfo.PreflightError, Reset)
+			continue
+		}
 		fmt.Printf("  "+Bold+"Backup Command:"+Reset+" %s\n", cmdInfo.BackupCmd)
 		fmt.Printf("  "+Bold+"Backup Output:"+Reset+" %s\n", strings.TrimSpace(cmdInfo.BackupOutput))
+		if cmdInfo.CleanupError != "" {
+			fmt.Printf("  "+Bold+"Cleanup Failed:"+Reset+" %s%s%s\n", Red, cmdInfo.CleanupError, Reset)
+		}
+		for _, alert := range cmdInfo.Alerts {
+			fmt.Printf("  "+Bold+"Alert:"+Reset+" %s%s%s\n", Yellow, alert, Reset)
+		}
 		fmt.Printf("  "+Bold+"Forget Command:"+Reset+" %s\n", cmdInfo.ForgetCmd)
 		fmt.Printf("  "+Bold+"Forget Output:"+Reset+" %s\n", strings.TrimSpace(cmdInfo.ForgetOutput))
+		for _, copyInfo := range cmdInfo.Copies {
+			if copyInfo.CopyCmd != "" {
+				fmt.Printf("  "+Bold+"Copy Command:"+Reset+" %s\n", copyInfo.CopyCmd)
+				fmt.Printf("  "+Bold+"Copy Output:"+Reset+" %s\n", strings.TrimSpace(copyInfo.CopyOutput))
+			} else {
+				fmt.Printf("  "+Bold+"Copy to %s failed:"+Reset+" %s\n", copyInfo.Repository, copyInfo.CopyError)
+			}
+			if copyInfo.ForgetCmd != "" {
+				fmt.Printf("  "+Bold+"Forget Command:"+Reset+" %s\n", copyInfo.ForgetCmd)
+				fmt.Printf("  "+Bold+"Forget Output:"+Reset+" %s\n", strings.TrimSpace(copyInfo.ForgetOutput))
+			}
+		}
 	}
 	fmt.Println("---------------")
 }
 
-func cmdSuccess(command string) (bool, string, string) {
-	var stdoutBuf, stderrBuf bytes.Buffer
+// pipeline is a command line of restic, optionally reading the output of a
+// dump command on its standard input.
+type pipeline struct {
+	Dump   []string
+	Restic []string
+}
 
-	// Special case: we have a MySQL dump piped to restic
-	if strings.HasPrefix(command, "mysqldump") {
-		parts := strings.Split(command, "|")
-		mysqldumpCmdStr := strings.TrimSpace(parts[0])
-		resticCmdStr := strings.TrimSpace(parts[1])
+func (p pipeline) String() string {
+	quote := func(args []string) string {
+		quoted := make([]string, len(args))
+		for i, arg := range args {
+			quoted[i] = shellQuote(arg)
+		}
+		return strings.Join(quoted, " ")
+	}
+	if len(p.Dump) > 0 {
+		return quote(p.Dump) + " | " + quote(p.Restic)
+	}
+	return quote(p.Restic)
+}
 
-		mysqldumpParts := strings.Fields(mysqldumpCmdStr)
-		resticParts := strings.Fields(resticCmdStr)
+// cmdSuccess runs the pipeline with env added to the environment of restic.
+func cmdSuccess(p pipeline, env []string) (bool, string, string) {
+	var stdoutBuf, stderrBuf bytes.Buffer
 
-		c1 := exec.Command(mysqldumpParts[0], mysqldumpParts[1:]...)
-		c2 := exec.Command(resticParts[0], resticParts[1:]...)
+	// A dump command piped to restic
+	if len(p.Dump) > 0 {
+		c1 := exec.Command(p.Dump[0], p.Dump[1:]...)
+		c2 := exec.Command(p.Restic[0], p.Restic[1:]...)
+		if len(env) > 0 {
+			c2.Env = append(os.Environ(), env...)
+		}
 
 		pr, pw := io.Pipe()
 		c1.Stdout = pw
@@ -232,8 +370,16 @@ func cmdSuccess(command string) (bool, string, string) {
 
 		var err1, err2 error
 
-		c1.Start()
-		c2.Start()
+		if err := c1.Start(); err != nil {
+			return false, "", err.Error()
+		}
+		defer trackCommand(c1)()
+		if err := c2.Start(); err != nil {
+			pw.Close()
+			c1.Wait()
+			return false, "", err.Error()
+		}
+		defer trackCommand(c2)()
 
 		go func() {
 			defer pw.Close()
@@ -248,461 +394,681 @@ func cmdSuccess(command string) (bool, string, string) {
 		return true, stdoutBuf.String(), stderrBuf.String()
 	}
 
-	// For all other commands
-	parts := strings.Fields(command)
-	head := parts[0]
-	parts = parts[1:]
-
-	cmd := exec.Command(head, parts...)
+	cmd := exec.Command(p.Restic[0], p.Restic[1:]...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
 	cmd.Stdout = &stdoutBuf
 	cmd.Stderr = &stderrBuf // Capture stderr as well
-	err := cmd.Run()
+	if err := cmd.Start(); err != nil {
+		return false, "", err.Error()
+	}
+	defer trackCommand(cmd)()
+	err := cmd.Wait()
 
 	return err == nil, stdoutBuf.String(), stderrBuf.String()
 }
 
+// runningCommands holds the processes started by cmdSuccess, so the daemon
+// can pass a stop signal on to a running backup.
+var runningCommands = struct {
+	sync.Mutex
+	procs map[*os.Process]bool
+}{procs: make(map[*os.Process]bool)}
+
+// trackCommand records a started command and returns the function which
+// forgets it again.
+func trackCommand(cmd *exec.Cmd) func() {
+	runningCommands.Lock()
+	runningCommands.procs[cmd.Process] = true
+	runningCommands.Unlock()
+	return func() {
+		runningCommands.Lock()
+		delete(runningCommands.procs, cmd.Process)
+		runningCommands.Unlock()
+	}
+}
+
+// signalCommands sends sig to every running command.
+func signalCommands(sig os.Signal) {
+	runningCommands.Lock()
+	defer runningCommands.Unlock()
+	for proc := range runningCommands.procs {
+		proc.Signal(sig)
+	}
+}
+
+// resticEnv returns the environment for the restic calls of a job.
+func resticEnv(settings *JobSettings) []string {
+	if settings.Password != "" {
+		return []string{"RESTIC_PASSWORD=" + settings.Password}
+	}
+	return nil
+}
+
+// repositoryEnv returns the restic environment of the first job, in name
+// order, which has a password for bucket, or else of the copy_to repository
+// with that bucket.
+func repositoryEnv(config Config, bucket string) []string {
+	for _, k := range sortedJobKeys(config) {
+		if settings := config.Jobs[k].Settings(); settings.Bucket == bucket && settings.Password != "" {
+			return resticEnv(settings)
+		}
+	}
+	var names []string
+	for name := range config.Repositories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if repo := config.Repositories[name]; repo.Bucket == bucket {
+			return repo.resticEnv()
+		}
+	}
+	return nil
+}
+
 func sanitizeName(name string) string {
 	replacer := strings.NewReplacer(":", "-", "/", "-", " ", "-")
 	return replacer.Replace(name)
 }
 
-func generateTimers(config Config) error {
-	unitOut, err := exec.Command("systemctl", "show", "--property=UnitPath").Output()
-	if err != nil {
-		return fmt.Errorf("failed to retrieve systemd unit path: %v", err)
-	}
-	unitLine := strings.TrimSpace(string(unitOut))
-	unitLine = strings.TrimPrefix(unitLine, "UnitPath=")
-	paths := strings.FieldsFunc(unitLine, func(r rune) bool { return r == ':' || r == ' ' })
-	unitDir := ""
-	for _, p := range paths {
-		if p == "/etc/systemd/system" {
-			if _, err := os.Stat(p); err == nil {
-				unitDir = p
-				break
-			}
-		}
+func findMailTemplate(customTemplate string) string {
+	return searchForFile(customTemplate, []string{
+		"./templates/mail_template.txt",
+		"/etc/resticara/templates/mail_template.txt",
+		filepath.Join(os.Getenv("HOME"), ".config/resticara/mail_template.txt"),
+	})
+}
+
+// runBackups runs the given jobs, sends the notifications and returns one of
+// the exit codes. Jobs which are already running in another process are
+// skipped.
+func runBackups(config Config, commandKeys []string, templatePath string, logger *slog.Logger) (MailData, int, error) {
+	runStart := time.Now()
+	mailData := MailData{
+		HostID:   resolveHostID(config),
+		Date:     runStart.Format(time.RFC1123),
+		Commands: []CommandInfo{},
 	}
-	if unitDir == "" {
-		for _, p := range paths {
-			if p == "" {
+	var failed, succeeded, locked, warnings int
+
+	commandRunner := DefaultCommandRunner{}
+
+	for _, commandKey := range commandKeys {
+		job := config.Jobs[commandKey]
+		settings := job.Settings()
+		lock, err := acquireLock(unitPrefix(config) + sanitizeName(commandKey))
+		if err == errLocked {
+			fmt.Printf("Skipping command %s, it is already running\n", commandKey)
+			logger.Warn("job skipped, already running", "job", commandKey)
+			mailData.Skipped = append(mailData.Skipped, commandKey)
+			locked++
+			continue
+		}
+
+		fmt.Printf("Executing command %s\n", commandKey)
+		commandInfo := CommandInfo{CommandKey: commandKey, Description: job.Describe()}
+		if err != nil {
+			fmt.Printf("%sLocking %s failed, skipping it: %v%s\n", Red, commandKey, err, Reset)
+			logger.Error("lock failed", "job", commandKey, "status", "failed", "error", err)
+			commandInfo.PreflightError = "lock: " + err.Error()
+			failed++
+			mailData.Commands = append(mailData.Commands, commandInfo)
+			continue
+		}
+
+		if err := job.Preflight(); err != nil {
+			fmt.Printf("%sPreflight check of %s failed, skipping it: %v%s\n", Red, commandKey, err, Reset)
+			logger.Error("preflight failed", "job", commandKey, "status", "failed", "error", err)
+			commandInfo.PreflightError = err.Error()
+			lock.Close()
+			failed++
+			mailData.Commands = append(mailData.Commands, commandInfo)
+			continue
+		}
+
+		backupCmd := job.BackupPipeline()
+		cleanup := func() error { return nil }
+		if prepared, ok := job.(preparedJob); ok {
+			backupCmd, cleanup, err = prepared.Prepare()
+			if err != nil {
+				if cerr := cleanup(); cerr != nil {
+					err = errors.Join(err, cerr)
+				}
+				fmt.Printf("%sPreparing %s failed, skipping it: %v%s\n", Red, commandKey, err, Reset)
+				logger.Error("prepare failed", "job", commandKey, "status", "failed", "error", err)
+				commandInfo.PreflightError = err.Error()
+				lock.Close()
+				failed++
+				mailData.Commands = append(mailData.Commands, commandInfo)
 				continue
 			}
-			if _, err := os.Stat(p); err == nil {
-				unitDir = p
-				break
+		}
+
+		bucket := settings.Bucket
+		forgetCmd := settings.ForgetPipeline()
+
+		start := time.Now()
+		env := resticEnv(settings)
+		success, stdout, stderr := commandRunner.Run(backupCmd, env)
+		duration := time.Since(start)
+		if err := cleanup(); err != nil {
+			fmt.Printf("%sCleaning up after %s failed: %v%s\n", Red, commandKey, err, Reset)
+			logger.Error("cleanup failed", "job", commandKey, "status", "failed", "error", err)
+			commandInfo.CleanupError = err.Error()
+		}
+		logPhase(logger, commandKey, "backup", bucket, duration, success, stdout, stderr)
+		commandInfo.BackupCmd = backupCmd.String()
+		commandInfo.BackupOutput = stdout + "\nStderr: " + stderr
+		commandInfo.BackupSuccess = success
+		commandInfo.BackupSeconds = duration.Seconds()
+		if !success {
+			commandInfo.BackupError = lastLine(stderr)
+		}
+
+		start = time.Now()
+		success, stdout, stderr = commandRunner.Run(forgetCmd, env)
+		duration = time.Since(start)
+		logPhase(logger, commandKey, "forget", bucket, duration, success, stdout, stderr)
+		commandInfo.ForgetCmd = forgetCmd.String()
+		commandInfo.ForgetOutput = stdout + "\nStderr: " + stderr
+		commandInfo.ForgetSuccess = success
+		commandInfo.ForgetSeconds = duration.Seconds()
+		if !success {
+			commandInfo.ForgetError = lastLine(stderr)
+		}
+
+		alerted := false
+		if commandInfo.BackupSuccess {
+			alerted = checkGrowth(&commandInfo, commandRunner, settings, logger)
+		}
+
+		copied := true
+		if commandInfo.BackupSuccess {
+			snapshotID := parseSnapshotID(commandInfo.BackupOutput)
+			for _, name := range settings.CopyTo {
+				fmt.Printf("Copying snapshot of %s to %s\n", commandKey, name)
+				copyInfo := copySnapshot(commandRunner, settings, config.Repositories[name], snapshotID, logger)
+				copied = copied && copyInfo.CopySuccess && copyInfo.ForgetSuccess
+				commandInfo.Copies = append(commandInfo.Copies, copyInfo)
 			}
 		}
+		lock.Close()
+
+		if commandInfo.BackupSuccess && commandInfo.ForgetSuccess && commandInfo.CleanupError == "" && copied && !(alerted && settings.AlertFail) {
+			succeeded++
+		} else {
+			failed++
+		}
+		if alerted {
+			warnings++
+		}
+		mailData.Commands = append(mailData.Commands, commandInfo)
 	}
-	if unitDir == "" {
-		return fmt.Errorf("could not determine systemd unit directory from UnitPath: %s", unitLine)
+
+	mailData.Seconds = time.Since(runStart).Seconds()
+	exitCode := jobsExitCode(failed, succeeded, locked)
+	if len(mailData.Commands) == 0 {
+		return mailData, exitCode, nil
 	}
 
-	type timerUnit struct {
-		commandKey string
-		sanitized  string
-		bucket     string
-		pruneDays  int
+	if failed == 0 && warnings == 0 {
+		mailData.StatusMessage = "Backup successful"
+	} else if failed == 0 {
+		mailData.StatusMessage = "Backup finished with warnings"
+	} else {
+		mailData.StatusMessage = "BACKUP FAILED! See output above."
 	}
-	var units []timerUnit
-	expected := make(map[string]struct{})
-	for commandKey, settings := range config.Commands {
-		sanitized := sanitizeName(commandKey)
-		pruneDays := config.RetentionPrune
-		if val, ok := settings["retention_prune"]; ok {
-			if d, err := strconv.Atoi(val); err == nil {
-				pruneDays = d
-			}
-		}
-		bucket := settings["bucket"]
-		units = append(units, timerUnit{
-			commandKey: commandKey,
-			sanitized:  sanitized,
-			bucket:     bucket,
-			pruneDays:  pruneDays,
-		})
-		expected["resticara-"+sanitized] = struct{}{}
-		expected["resticara-"+sanitized+"-prune"] = struct{}{}
+
+	tmpl, err := template.ParseFiles(templatePath)
+	if err != nil {
+		return mailData, exitConfigError, fmt.Errorf("Error parsing template: %v", err)
 	}
 
-	entries, err := os.ReadDir(unitDir)
+	var mailMessageBuffer bytes.Buffer
+	err = tmpl.Execute(&mailMessageBuffer, mailData)
 	if err != nil {
-		return err
+		return mailData, exitConfigError, fmt.Errorf("Error executing template: %v", err)
 	}
-	existing := make(map[string]struct{})
-	for _, e := range entries {
-		name := e.Name()
-		if !strings.HasPrefix(name, "resticara-") {
-			continue
+
+	var matrixMessageBuffer bytes.Buffer
+	if config.MatrixEnabled {
+		matrixTemplatePath := filepath.Join("templates", "matrix_template.html")
+		matrixTmpl, err := htmlTemplate.ParseFiles(matrixTemplatePath)
+		if err != nil {
+			return mailData, exitConfigError, fmt.Errorf("Error parsing matrix template: %v", err)
 		}
-		if !(strings.HasSuffix(name, ".service") || strings.HasSuffix(name, ".timer")) {
-			continue
+		if err := matrixTmpl.Execute(&matrixMessageBuffer, mailData); err != nil {
+			return mailData, exitConfigError, fmt.Errorf("Error executing matrix template: %v", err)
 		}
-		base := strings.TrimSuffix(strings.TrimSuffix(name, ".service"), ".timer")
-		existing[base] = struct{}{}
 	}
-	for base := range existing {
-		if _, ok := expected[base]; !ok {
-			exec.Command("systemctl", "disable", "--now", base+".timer").Run()
-			exec.Command("systemctl", "disable", "--now", base+".service").Run()
-			os.Remove(filepath.Join(unitDir, base+".timer"))
-			os.Remove(filepath.Join(unitDir, base+".service"))
+
+	var telegramMessageBuffer bytes.Buffer
+	if config.TelegramEnabled {
+		telegramTemplatePath := filepath.Join("templates", "telegram_template.html")
+		telegramTmpl, err := htmlTemplate.ParseFiles(telegramTemplatePath)
+		if err != nil {
+			return mailData, exitConfigError, fmt.Errorf("Error parsing telegram template: %v", err)
+		}
+		if err := telegramTmpl.Execute(&telegramMessageBuffer, mailData); err != nil {
+			return mailData, exitConfigError, fmt.Errorf("Error executing telegram template: %v", err)
 		}
 	}
 
-	var timers []string
-	for _, u := range units {
-		backupService := fmt.Sprintf(`[Unit]
-Description=Resticara backup for %s
-
-[Service]
-Type=oneshot
-ExecStart=/usr/local/bin/resticara run %s
-
-[Install]
-WantedBy=multi-user.target
-`, u.commandKey, u.commandKey)
+	printSummary(mailData, logger)
 
-		backupTimer := fmt.Sprintf(`[Unit]
-Description=Resticara backup timer for %s
-
-[Timer]
-OnCalendar=daily
-Persistent=true
-
-[Install]
-WantedBy=timers.target
-`, u.commandKey)
-
-		pruneService := fmt.Sprintf(`[Unit]
-Description=Resticara prune for %s
-
-[Service]
-Type=oneshot
-ExecStart=/usr/local/bin/resticara prune %s
+	notified := sendNotifications(config, mailData.StatusMessage+"---"+time.Now().Format(time.RFC1123),
+		mailMessageBuffer.String(), matrixMessageBuffer.String(), telegramMessageBuffer.String())
+	if !notified && exitCode == exitOK {
+		exitCode = exitNotifyFailed
+	}
 
-[Install]
-WantedBy=multi-user.target
-`, u.commandKey, u.bucket)
+	return mailData, exitCode, nil
+}
 
-		pruneTimer := fmt.Sprintf(`[Unit]
-Description=Resticara prune timer for %s
+// pruneRepository prunes one repository, the result carries one of the exit
+// codes. A repository is pruned by only one resticara process at a time.
+func pruneRepository(bucket string, env []string, logger *slog.Logger) PruneResult {
+	result := PruneResult{Repository: bucket}
+	lock, err := acquireLock("prune-" + sanitizeName(bucket))
+	if err == errLocked {
+		fmt.Printf("Skipping prune of %s, it is already running\n", bucket)
+		logger.Warn("prune skipped, already running", "repo", bucket)
+		result.Error = err.Error()
+		result.ExitCode = exitLocked
+		return result
+	} else if err != nil {
+		fmt.Println(err)
+		result.Error = err.Error()
+		result.ExitCode = exitFailure
+		return result
+	}
+	defer lock.Close()
+
+	fmt.Printf("Pruning repository %s\n", bucket)
+	start := time.Now()
+	success, stdout, stderr := DefaultCommandRunner{}.Run(pipeline{Restic: []string{"restic", "-r", bucket, "prune"}}, env)
+	duration := time.Since(start)
+	logPhase(logger, "", "prune", bucket, duration, success, stdout, stderr)
+	fmt.Print(stdout)
+	if stderr != "" {
+		fmt.Printf("Stderr: %s\n", stderr)
+	}
+	result.Output = stdout + "\nStderr: " + stderr
+	result.Seconds = duration.Seconds()
+	if !success {
+		fmt.Printf("Prune failed for %s\n", bucket)
+		result.Error = lastLine(stderr)
+		result.ExitCode = exitFailure
+	}
+	return result
+}
 
-[Timer]
-OnUnitActiveSec=%dd
-Persistent=true
+// resolveInvocation returns the absolute paths of the running binary and of
+// the config file, for use in generated units and cron files.
+func resolveInvocation(configPath string) (string, string, error) {
+	binary, err := os.Executable()
+	if err == nil {
+		binary, err = filepath.EvalSymlinks(binary)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("Error resolving resticara binary path: %v", err)
+	}
+	absConfig, err := filepath.Abs(configPath)
+	if err != nil {
+		return "", "", fmt.Errorf("Error resolving config path: %v", err)
+	}
+	return binary, absConfig, nil
+}
 
-[Install]
-WantedBy=timers.target
-`, u.commandKey, u.pruneDays)
+func resolveHostID(config Config) string {
+	hostID := config.HostID
+	if hostID == "hostname" {
+		host, err := os.Hostname()
+		if err != nil {
+			fmt.Println("Could not determine hostname, using 'Unknown'")
+			hostID = "Unknown"
+		} else {
+			hostID = host
+		}
+	}
+	return hostID
+}
 
-		if err := os.WriteFile(filepath.Join(unitDir, fmt.Sprintf("resticara-%s.service", u.sanitized)), []byte(backupService), 0644); err != nil {
-			return err
+// sendNotifications sends the message through every enabled notifier and
+// reports whether all of them succeeded.
+func sendNotifications(config Config, subject, mailMessage, matrixMessage, telegramMessage string) bool {
+	success := true
+	if config.SMTPEnabled {
+		emailNotifier := email.SmtpEmailNotifier{}
+		emailConfig := email.EmailConfig{
+			From:       config.From,
+			Username:   config.Username,
+			Password:   config.Pass,
+			To:         config.To,
+			SmtpServer: config.SMTPServer,
+			SmtpPort:   config.SMTPPort,
+			Subject:    subject,
+			Body:       mailMessage,
 		}
-		if err := os.WriteFile(filepath.Join(unitDir, fmt.Sprintf("resticara-%s.timer", u.sanitized)), []byte(backupTimer), 0644); err != nil {
-			return err
+
+		if err := emailNotifier.Send(emailConfig); err != nil {
+			fmt.Println(err)
+			success = false
+		} else {
+			fmt.Println("Email sent!")
 		}
-		if err := os.WriteFile(filepath.Join(unitDir, fmt.Sprintf("resticara-%s-prune.service", u.sanitized)), []byte(pruneService), 0644); err != nil {
-			return err
+	} else {
+		fmt.Println("SMTP is disabled, not sending email.")
+	}
+
+	if config.MatrixEnabled {
+		matrixNotifier := matrix.GomatrixNotifier{}
+		matrixConfig := matrix.MatrixConfig{
+			Homeserver: config.MatrixServer,
+			Username:   config.MatrixUser,
+			Password:   config.MatrixPass,
+			RoomID:     config.MatrixRoomID,
+			Message:    matrixMessage,
 		}
-		if err := os.WriteFile(filepath.Join(unitDir, fmt.Sprintf("resticara-%s-prune.timer", u.sanitized)), []byte(pruneTimer), 0644); err != nil {
-			return err
+
+		if err := matrixNotifier.Send(matrixConfig); err != nil {
+			fmt.Println(err)
+			success = false
+		} else {
+			fmt.Println("Matrix message sent!")
 		}
-		timers = append(timers, fmt.Sprintf("resticara-%s.timer", u.sanitized))
-		timers = append(timers, fmt.Sprintf("resticara-%s-prune.timer", u.sanitized))
+	} else {
+		fmt.Println("Matrix is disabled, not sending message.")
 	}
 
-	if err := exec.Command("systemctl", "daemon-reload").Run(); err != nil {
-		return fmt.Errorf("failed to reload systemd daemon: %v", err)
-	}
-	for _, t := range timers {
-		if err := exec.Command("systemctl", "enable", t).Run(); err != nil {
-			return fmt.Errorf("failed to enable %s: %v", t, err)
+	if config.TelegramEnabled {
+		telegramNotifier := telegram.BotAPINotifier{}
+		telegramConfig := telegram.TelegramConfig{
+			BotToken: config.TelegramToken,
+			ChatID:   config.TelegramChatID,
+			Message:  telegramMessage,
 		}
-		if err := exec.Command("systemctl", "restart", t).Run(); err != nil {
-			return fmt.Errorf("failed to restart %s: %v", t, err)
+
+		if err := telegramNotifier.Send(telegramConfig); err != nil {
+			fmt.Println(err)
+			success = false
+		} else {
+			fmt.Println("Telegram message sent!")
 		}
+	} else {
+		fmt.Println("Telegram is disabled, not sending message.")
 	}
+	return success
+}
 
-	fmt.Printf("Systemd timer files written to %s and activated.\n", unitDir)
-	return nil
+// notifyUnitFailure reports a failed systemd unit through all enabled
+// notifiers. It is called from the OnFailure= unit written by gentimer.
+func notifyUnitFailure(config Config, unit string, user bool) bool {
+	statusArgs := []string{"status", "--no-pager", "--lines=30", unit}
+	if user {
+		statusArgs = append([]string{"--user"}, statusArgs...)
+	}
+	// systemctl status exits non-zero for failed units, the output is still useful
+	status, _ := exec.Command("systemctl", statusArgs...).CombinedOutput()
+
+	hostID := resolveHostID(config)
+	subject := fmt.Sprintf("Resticara unit %s failed on %s", unit, hostID)
+	text := subject + "\n\n" + strings.TrimSpace(string(status)) + "\n"
+	html := fmt.Sprintf("<b>❌ %s</b><br/><pre><code>%s</code></pre>",
+		htmlTemplate.HTMLEscapeString(subject), htmlTemplate.HTMLEscapeString(strings.TrimSpace(string(status))))
+	return sendNotifications(config, subject, text, html, html)
 }
 
 type DefaultCommandRunner struct{}
 
-func (runner DefaultCommandRunner) Run(cmd string) (bool, string, string) {
-	return cmdSuccess(cmd) // Here cmdSuccess is your existing function
+func (runner DefaultCommandRunner) Run(cmd pipeline, env []string) (bool, string, string) {
+	return cmdSuccess(cmd, env) // Here cmdSuccess is your existing function
 }
 
 func main() {
-	logwriter, err := syslog.New(syslog.LOG_NOTICE, "resticara")
-	if err != nil {
-		log.Fatal("Failed to initialize syslog writer:", err)
-	}
-	defer logwriter.Close()
+	os.Exit(realMain())
+}
 
-	customConfig := flag.String("config", "", "Path to custom config.ini file")
+// realMain runs the command line and returns the exit code, so deferred
+// cleanups run before the process exits.
+func realMain() int {
+	customConfig := flag.String("config", "", "Path to custom config file (.ini, .yaml or .toml)")
 	customTemplate := flag.String("mail_template", "", "Path to custom mail template file")
+	outputFormat := flag.String("output", "text", "Output format, text or json")
 	flag.Parse()
 
+	if err := setupOutput(*outputFormat); err != nil {
+		fmt.Println(err)
+		return exitConfigError
+	}
+
 	args := flag.Args()
 	if len(args) == 0 {
 		printUsage()
-		return
+		return exitConfigError
 	}
 
-	configPath := searchForFile(*customConfig, []string{
-		"./config.ini",
-		"/etc/resticara/config.ini",
-		filepath.Join(os.Getenv("HOME"), ".config/resticara/config.ini"),
-	})
+	var configPaths []string
+	for _, dir := range []string{".", "/etc/resticara", filepath.Join(os.Getenv("HOME"), ".config/resticara")} {
+		for _, name := range []string{"config.ini", "config.yaml", "config.yml", "config.toml"} {
+			configPaths = append(configPaths, filepath.Join(dir, name))
+		}
+	}
+	configPath := searchForFile(*customConfig, configPaths)
 	if configPath == "" {
-		fmt.Println("Error: config.ini not found in any of the expected locations")
-		return
+		return fail(exitConfigError, "Error: no config.ini, config.yaml or config.toml found in any of the expected locations")
+	}
+	if args[0] == "config" {
+		return configCommand(configPath, args[1:])
 	}
 
 	config, err := readConfig(configPath)
 	if err != nil {
-		fmt.Printf("Error reading config: %v\n", err)
-		return
+		return fail(exitConfigError, "Error reading config: %v", err)
 	}
 
+	logger, logCloser, err := newLogger(config)
+	if err != nil {
+		fmt.Printf("Error initializing logging, logging to stderr instead: %v\n", err)
+		logger, logCloser = slog.New(slog.NewTextHandler(os.Stderr, nil)), io.NopCloser(nil)
+	}
+	defer logCloser.Close()
+
 	switch args[0] {
 	case "run":
-		templatePath := searchForFile(*customTemplate, []string{
-			"./templates/mail_template.txt",
-			"/etc/resticara/templates/mail_template.txt",
-			filepath.Join(os.Getenv("HOME"), ".config/resticara/mail_template.txt"),
-		})
+		templatePath := findMailTemplate(*customTemplate)
 		if templatePath == "" {
-			fmt.Println("Error: mail_template.txt not found in any of the expected locations")
-			return
+			return fail(exitConfigError, "Error: mail_template.txt not found in any of the expected locations")
 		}
 
-		hostID := config.HostID
-		if hostID == "hostname" {
-			host, err := os.Hostname()
-			if err != nil {
-				fmt.Println("Could not determine hostname, using 'Unknown'")
-				hostID = "Unknown"
-			} else {
-				hostID = host
-			}
-		}
-
-		mailData := MailData{
-			HostID: hostID,
-			Date:   time.Now().Format(time.RFC1123),
-		}
-		allSuccess := true
-
-		commandRunner := DefaultCommandRunner{}
-
 		var commandKeys []string
 		if len(args) > 1 {
-			if _, ok := config.Commands[args[1]]; !ok {
-				fmt.Printf("Command %s not found in config\n", args[1])
-				return
+			if _, ok := config.Jobs[args[1]]; !ok {
+				return fail(exitConfigError, "Command %s not found in config", args[1])
 			}
 			commandKeys = []string{args[1]}
 		} else {
-			for k := range config.Commands {
-				commandKeys = append(commandKeys, k)
-			}
-		}
-
-		for _, commandKey := range commandKeys {
-			settings := config.Commands[commandKey]
-			fmt.Printf("Executing command %s\n", commandKey)
-			commandInfo := CommandInfo{CommandKey: commandKey}
-
-			var backupCmd, forgetCmd string
-			bucket := settings["bucket"]
-			retentionDaily := settings["retention_daily"]
-			retentionWeekly := settings["retention_weekly"]
-			retentionMonthly := settings["retention_monthly"]
-
-			if strings.HasPrefix(commandKey, "dir:") {
-				directory := settings["directory"]
-				backupCmd = fmt.Sprintf("restic -r %s backup %s", bucket, directory)
-				forgetCmd = fmt.Sprintf("restic -r %s forget --keep-daily %s --keep-weekly %s --keep-monthly %s", bucket, retentionDaily, retentionWeekly, retentionMonthly)
-			} else if strings.HasPrefix(commandKey, "mysql:") {
-				database := settings["database"]
-				backupCmd = fmt.Sprintf("mysqldump %s | restic -r %s backup --stdin --stdin-filename %s.sql", database, bucket, database)
-				forgetCmd = fmt.Sprintf("restic -r %s forget --keep-daily %s --keep-weekly %s --keep-monthly %s", bucket, retentionDaily, retentionWeekly, retentionMonthly)
-			}
-
-			success, stdout, stderr := commandRunner.Run(backupCmd)
-			commandInfo.BackupCmd = backupCmd
-			commandInfo.BackupOutput = stdout + "\nStderr: " + stderr
-			allSuccess = allSuccess && success
-
-			success, stdout, stderr = commandRunner.Run(forgetCmd)
-			commandInfo.ForgetCmd = forgetCmd
-			commandInfo.ForgetOutput = stdout + "\nStderr: " + stderr
-			allSuccess = allSuccess && success
-
-			mailData.Commands = append(mailData.Commands, commandInfo)
-		}
-
-		if allSuccess {
-			mailData.StatusMessage = "Backup successful"
-		} else {
-			mailData.StatusMessage = "BACKUP FAILED! See output above."
+			commandKeys = sortedJobKeys(config)
 		}
 
-		tmpl, err := template.ParseFiles(templatePath)
+		mailData, exitCode, err := runBackups(config, commandKeys, templatePath, logger)
 		if err != nil {
-			fmt.Println("Error parsing template:", err)
-			return
+			fmt.Println(err)
+			mailData.Error = err.Error()
 		}
-
-		var mailMessageBuffer bytes.Buffer
-		err = tmpl.Execute(&mailMessageBuffer, mailData)
-		if err != nil {
-			fmt.Println("Error executing template:", err)
-			return
+		mailData.ExitCode = exitCode
+		writeReport(mailData)
+		return exitCode
+	case "prune":
+		if len(args) < 2 {
+			return fail(exitConfigError, "Usage: resticara prune <all|repository...>")
 		}
-
-		var matrixMessageBuffer bytes.Buffer
-		if config.MatrixEnabled {
-			matrixTemplatePath := filepath.Join("templates", "matrix_template.html")
-			matrixTmpl, err := htmlTemplate.ParseFiles(matrixTemplatePath)
-			if err != nil {
-				fmt.Println("Error parsing matrix template:", err)
-				return
-			}
-			if err := matrixTmpl.Execute(&matrixMessageBuffer, mailData); err != nil {
-				fmt.Println("Error executing matrix template:", err)
-				return
-			}
+		uniqueBuckets := make(map[string]bool)
+		for _, job := range config.Jobs {
+			uniqueBuckets[job.Settings().Bucket] = true
 		}
-
-		var telegramMessageBuffer bytes.Buffer
-		if config.TelegramEnabled {
-			telegramTemplatePath := filepath.Join("templates", "telegram_template.html")
-			telegramTmpl, err := htmlTemplate.ParseFiles(telegramTemplatePath)
-			if err != nil {
-				fmt.Println("Error parsing telegram template:", err)
-				return
-			}
-			if err := telegramTmpl.Execute(&telegramMessageBuffer, mailData); err != nil {
-				fmt.Println("Error executing telegram template:", err)
-				return
-			}
+		for _, repo := range config.Repositories {
+			uniqueBuckets[repo.Bucket] = true
 		}
 
-		printSummary(mailData, logwriter)
-
-		if config.SMTPEnabled {
-			emailNotifier := email.SmtpEmailNotifier{}
-			mailMessage := mailMessageBuffer.String()
-			mailSubject := mailData.StatusMessage + "---" + time.Now().Format(time.RFC1123)
-			emailConfig := email.EmailConfig{
-				From:       config.From,
-				Username:   config.Username,
-				Password:   config.Pass,
-				To:         config.To,
-				SmtpServer: config.SMTPServer,
-				SmtpPort:   config.SMTPPort,
-				Subject:    mailSubject,
-				Body:       mailMessage,
-			}
-
-			if err := emailNotifier.Send(emailConfig); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println("Email sent!")
+		var buckets []string
+		if args[1] == "all" {
+			for bucket := range uniqueBuckets {
+				buckets = append(buckets, bucket)
 			}
+			sort.Strings(buckets)
 		} else {
-			fmt.Println("SMTP is disabled, not sending email.")
-		}
-
-		if config.MatrixEnabled {
-			matrixNotifier := matrix.GomatrixNotifier{}
-			message := matrixMessageBuffer.String()
-			matrixConfig := matrix.MatrixConfig{
-				Homeserver: config.MatrixServer,
-				Username:   config.MatrixUser,
-				Password:   config.MatrixPass,
-				RoomID:     config.MatrixRoomID,
-				Message:    message,
+			for _, repoArg := range args[1:] {
+				if !uniqueBuckets[repoArg] {
+					return fail(exitConfigError, "Repository %s not found in config", repoArg)
+				}
+				buckets = append(buckets, repoArg)
 			}
+		}
 
-			if err := matrixNotifier.Send(matrixConfig); err != nil {
-				fmt.Println(err)
-			} else {
-				fmt.Println("Matrix message sent!")
+		report := struct {
+			Repositories []PruneResult `json:"repositories"`
+			ExitCode     int           `json:"exit_code"`
+		}{}
+		var failed, succeeded, locked int
+		for _, bucket := range buckets {
+			result := pruneRepository(bucket, repositoryEnv(config, bucket), logger)
+			switch result.ExitCode {
+			case exitOK:
+				succeeded++
+			case exitLocked:
+				locked++
+			default:
+				failed++
 			}
-		} else {
-			fmt.Println("Matrix is disabled, not sending message.")
+			report.Repositories = append(report.Repositories, result)
 		}
-
-		if config.TelegramEnabled {
-			telegramNotifier := telegram.BotAPINotifier{}
-			message := telegramMessageBuffer.String()
-			telegramConfig := telegram.TelegramConfig{
-				BotToken: config.TelegramToken,
-				ChatID:   config.TelegramChatID,
-				Message:  message,
+		report.ExitCode = jobsExitCode(failed, succeeded, locked)
+		writeReport(report)
+		return report.ExitCode
+	case "tag-snapshots":
+		if len(args) < 2 {
+			return fail(exitConfigError, "Usage: resticara tag-snapshots <all|job...>")
+		}
+		commandKeys := args[1:]
+		if args[1] == "all" {
+			commandKeys = sortedJobKeys(config)
+		}
+		for _, commandKey := range commandKeys {
+			if _, ok := config.Jobs[commandKey]; !ok {
+				return fail(exitConfigError, "Command %s not found in config", commandKey)
 			}
-
-			if err := telegramNotifier.Send(telegramConfig); err != nil {
-				fmt.Println(err)
+		}
+		report := struct {
+			Jobs     []TagResult `json:"jobs"`
+			ExitCode int         `json:"exit_code"`
+		}{}
+		var failed, succeeded int
+		for _, commandKey := range commandKeys {
+			result := tagLegacySnapshots(config, commandKey, logger)
+			if result.ExitCode == exitOK {
+				succeeded++
 			} else {
-				fmt.Println("Telegram message sent!")
+				failed++
 			}
-		} else {
-			fmt.Println("Telegram is disabled, not sending message.")
+			report.Jobs = append(report.Jobs, result)
 		}
-	case "prune":
+		report.ExitCode = jobsExitCode(failed, succeeded, 0)
+		writeReport(report)
+		return report.ExitCode
+	case "restore":
 		if len(args) < 2 {
-			fmt.Println("Usage: resticara prune <all|repository>")
-			return
+			return fail(exitConfigError, "Usage: resticara restore <job> [snapshot] [-- restore options]")
 		}
-		repoArg := args[1]
-		uniqueBuckets := make(map[string]bool)
-		for _, settings := range config.Commands {
-			bucket := settings["bucket"]
-			uniqueBuckets[bucket] = true
+		if _, ok := config.Jobs[args[1]]; !ok {
+			return fail(exitConfigError, "Command %s not found in config", args[1])
 		}
-
-		commandRunner := DefaultCommandRunner{}
-
-		if repoArg == "all" {
-			for bucket := range uniqueBuckets {
-				fmt.Printf("Pruning repository %s\n", bucket)
-				success, stdout, stderr := commandRunner.Run(fmt.Sprintf("restic -r %s prune", bucket))
-				fmt.Print(stdout)
-				if stderr != "" {
-					fmt.Printf("Stderr: %s\n", stderr)
-				}
-				if !success {
-					fmt.Printf("Prune failed for %s\n", bucket)
-				}
-			}
-		} else {
-			if !uniqueBuckets[repoArg] {
-				fmt.Printf("Repository %s not found in config\n", repoArg)
-				return
-			}
-			fmt.Printf("Pruning repository %s\n", repoArg)
-			success, stdout, stderr := commandRunner.Run(fmt.Sprintf("restic -r %s prune", repoArg))
-			fmt.Print(stdout)
-			if stderr != "" {
-				fmt.Printf("Stderr: %s\n", stderr)
-			}
-			if !success {
-				fmt.Printf("Prune failed for %s\n", repoArg)
-			}
+		snapshot := "latest"
+		rest := args[2:]
+		if len(rest) > 0 && rest[0] != "--" {
+			snapshot, rest = rest[0], rest[1:]
+		}
+		if len(rest) > 0 && rest[0] == "--" {
+			rest = rest[1:]
+		} else if len(rest) > 0 {
+			return fail(exitConfigError, "Usage: resticara restore <job> [snapshot] [-- restore options]")
 		}
+		result := restoreDump(config, args[1], snapshot, rest, logger)
+		writeReport(result)
+		return result.ExitCode
+	case "daemon":
+		templatePath := findMailTemplate(*customTemplate)
+		if templatePath == "" {
+			return fail(exitConfigError, "Error: mail_template.txt not found in any of the expected locations")
+		}
+		if err := runDaemon(config, configPath, templatePath, logger); err != nil {
+			return fail(exitFailure, "Error running daemon: %v", err)
+		}
+	case "gencron":
+		cronFlags := flag.NewFlagSet("gencron", flag.ExitOnError)
+		var opts cronOptions
+		cronFlags.BoolVar(&opts.DryRun, "dry-run", false, "Print the cron file to stdout instead of writing it")
+		cronFlags.StringVar(&opts.File, "file", "", "Path of the cron file (default /etc/cron.d/resticara[-instance])")
+		cronFlags.StringVar(&opts.User, "user", "root", "User the jobs run as")
+		cronFlags.Parse(args[1:])
+		if opts.File == "" {
+			opts.File = "/etc/cron.d/" + strings.TrimSuffix(unitPrefix(config), "-")
+		}
+		binary, absConfig, err := resolveInvocation(configPath)
+		if err != nil {
+			return fail(exitFailure, "%v", err)
+		}
+		opts.Binary = binary
+		opts.ConfigPath = absConfig
+		report, err := generateCron(config, opts)
+		if err != nil {
+			return fail(exitFailure, "Error generating cron file: %v", err)
+		}
+		writeReport(report)
+	case "notify-failure":
+		notifyFlags := flag.NewFlagSet("notify-failure", flag.ExitOnError)
+		user := notifyFlags.Bool("user", false, "Query the user service manager")
+		notifyFlags.Parse(args[1:])
+		if notifyFlags.NArg() < 1 {
+			return fail(exitConfigError, "Usage: resticara notify-failure [--user] <unit>")
+		}
+		report := struct {
+			Unit     string `json:"unit"`
+			Notified bool   `json:"notified"`
+			ExitCode int    `json:"exit_code"`
+		}{Unit: notifyFlags.Arg(0)}
+		report.Notified = notifyUnitFailure(config, report.Unit, *user)
+		if !report.Notified {
+			report.ExitCode = exitNotifyFailed
+		}
+		writeReport(report)
+		return report.ExitCode
 	case "gentimer":
-		if err := generateTimers(config); err != nil {
-			fmt.Printf("Error generating timers: %v\n", err)
+		timerFlags := flag.NewFlagSet("gentimer", flag.ExitOnError)
+		var opts timerOptions
+		timerFlags.BoolVar(&opts.DryRun, "dry-run", false, "Show the units that would be created, changed and removed")
+		timerFlags.StringVar(&opts.OutputDir, "output-dir", "", "Write the units to this directory instead of the systemd unit directory")
+		timerFlags.BoolVar(&opts.NoActivate, "no-activate", false, "Do not call systemctl to reload, enable or disable units")
+		timerFlags.BoolVar(&opts.User, "user", false, "Generate user units in ~/.config/systemd/user and use systemctl --user")
+		timerFlags.Parse(args[1:])
+		// the units name the config explicitly, so every instance runs
+		// with its own
+		binary, absConfig, err := resolveInvocation(configPath)
+		if err != nil {
+			return fail(exitFailure, "%v", err)
 		}
+		opts.Binary = binary
+		opts.ConfigPath = absConfig
+		report, err := generateTimers(config, opts)
+		if err != nil {
+			return fail(exitFailure, "Error generating timers: %v", err)
+		}
+		writeReport(report)
 	default:
 		printUsage()
+		return exitConfigError
 	}
-
-	defer logwriter.Close()
+	return exitOK
 }
@@ -0,0 +1,159 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// MongoDBJob streams a mongodump archive into restic, from [mongodb:NAME]
+// sections. The connection string is read by mongodump from uri_file, so
+// credentials never appear on the command line.
+type MongoDBJob struct {
+	JobSettings
+	URIFile    string
+	Database   string
+	Collection string
+	Oplog      bool
+	Gzip       bool
+
+	settings map[string]string
+}
+
+func init() {
+	registerJobType("mongodb", jobType{
+		required: []string{"bucket", "uri_file", "retention_daily", "retention_weekly", "retention_monthly"},
+		optional: []string{"database", "collection", "oplog", "gzip"},
+		new: func(common JobSettings, settings map[string]string) Job {
+			job := &MongoDBJob{
+				JobSettings: common,
+				URIFile:     strings.TrimSpace(settings["uri_file"]),
+				Database:    strings.TrimSpace(settings["database"]),
+				Collection:  strings.TrimSpace(settings["collection"]),
+				settings:    settings,
+			}
+			// invalid values are reported by Validate
+			job.Oplog, _ = parseBool(settings["oplog"])
+			job.Gzip, _ = parseBool(settings["gzip"])
+			return job
+		},
+	})
+}
+
+func (j *MongoDBJob) Settings() *JobSettings {
+	return &j.JobSettings
+}
+
+func (j *MongoDBJob) Validate() []settingError {
+	var errs []settingError
+	for _, key := range []string{"oplog", "gzip"} {
+		if val, ok := j.settings[key]; ok {
+			if _, err := parseBool(val); err != nil {
+				errs = append(errs, settingError{j.Key, key, fmt.Errorf("must be a boolean")})
+			}
+		}
+	}
+	for _, key := range []string{"database", "collection"} {
+		if strings.ContainsAny(j.settings[key], " \t") {
+			errs = append(errs, settingError{j.Key, key, fmt.Errorf("must be a single name")})
+		}
+	}
+	if j.Collection != "" && j.Database == "" {
+		errs = append(errs, settingError{j.Key, "collection", fmt.Errorf("requires 'database'")})
+	}
+	if j.Oplog && j.Database != "" {
+		errs = append(errs, settingError{j.Key, "oplog", fmt.Errorf("only works for dumps of all databases, remove 'database'")})
+	}
+	return errs
+}
+
+// Preflight checks that mongodump is installed and the URI file is
+// readable.
+func (j *MongoDBJob) Preflight() error {
+	if _, err := exec.LookPath("mongodump"); err != nil {
+		return fmt.Errorf("mongodump not found in PATH")
+	}
+	file, err := os.Open(j.URIFile)
+	if err != nil {
+		return fmt.Errorf("uri_file: %v", err)
+	}
+	return file.Close()
+}
+
+// archiveName is the file name of the archive in the snapshot.
+func (j *MongoDBJob) archiveName() string {
+	name := j.Name
+	if j.Database != "" {
+		name = j.Database
+		if j.Collection != "" {
+			name += "." + j.Collection
+		}
+	}
+	if j.Gzip {
+		return name + ".archive.gz"
+	}
+	return name + ".archive"
+}
+
+func (j *MongoDBJob) BackupPipeline() pipeline {
+	dump := []string{"mongodump", "--config", j.URIFile, "--archive"}
+	if j.Database != "" {
+		dump = append(dump, "--db", j.Database)
+	}
+	if j.Collection != "" {
+		dump = append(dump, "--collection", j.Collection)
+	}
+	if j.Oplog {
+		dump = append(dump, "--oplog")
+	}
+	if j.Gzip {
+		dump = append(dump, "--gzip")
+	}
+	return pipeline{
+		Dump:   dump,
+		Restic: append(j.backupArgs(), "--stdin", "--stdin-filename", j.archiveName()),
+	}
+}
+
+// RestoreCommand returns mongorestore reading the archive, replaying the
+// oplog when it was dumped.
+func (j *MongoDBJob) RestoreCommand(extra []string) (string, []string) {
+	restore := []string{"mongorestore", "--config", j.URIFile, "--archive"}
+	if j.Gzip {
+		restore = append(restore, "--gzip")
+	}
+	if j.Oplog {
+		restore = append(restore, "--oplogReplay")
+	}
+	return "/" + j.archiveName(), append(restore, extra...)
+}
+
+func (j *MongoDBJob) ReadPaths() []string {
+	return []string{j.URIFile}
+}
+
+func (j *MongoDBJob) Describe() string {
+	switch {
+	case j.Collection != "":
+		return "MongoDB collection " + j.Database + "." + j.Collection
+	case j.Database != "":
+		return "MongoDB database " + j.Database
+	}
+	return "MongoDB databases"
+}
@@ -0,0 +1,76 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// MySQLJob streams mysqldump of a database into restic, from [mysql:NAME]
+// sections.
+type MySQLJob struct {
+	JobSettings
+	Database string
+}
+
+func init() {
+	registerJobType("mysql", jobType{
+		required: []string{"bucket", "database", "retention_daily", "retention_weekly", "retention_monthly"},
+		new: func(common JobSettings, settings map[string]string) Job {
+			return &MySQLJob{JobSettings: common, Database: strings.TrimSpace(settings["database"])}
+		},
+	})
+}
+
+func (j *MySQLJob) Settings() *JobSettings {
+	return &j.JobSettings
+}
+
+func (j *MySQLJob) Validate() []settingError {
+	if strings.ContainsAny(j.Database, " \t") {
+		return []settingError{{j.Key, "database", fmt.Errorf("must be a single database name")}}
+	}
+	return nil
+}
+
+// Preflight checks that mysqldump is installed and can connect to the
+// database, by dumping nothing but the connection.
+func (j *MySQLJob) Preflight() error {
+	if _, err := exec.LookPath("mysqldump"); err != nil {
+		return fmt.Errorf("mysqldump not found in PATH")
+	}
+	if err := runCheck("mysqldump", "--no-data", "--no-create-info", "--skip-triggers", j.Database); err != nil {
+		return fmt.Errorf("database %s is not reachable: %v", j.Database, err)
+	}
+	return nil
+}
+
+func (j *MySQLJob) BackupPipeline() pipeline {
+	return pipeline{
+		Dump:   []string{"mysqldump", j.Database},
+		Restic: append(j.backupArgs(), "--stdin", "--stdin-filename", j.Database+".sql"),
+	}
+}
+
+func (j *MySQLJob) ReadPaths() []string {
+	return nil
+}
+
+func (j *MySQLJob) Describe() string {
+	return "MySQL database " + j.Database
+}
@@ -3,6 +3,7 @@ package email
 import (
 	"fmt"
 	"net/smtp"
+	"strings"
 )
 
 type EmailConfig struct {
@@ -22,15 +23,23 @@ type EmailNotifier interface {
 
 type SmtpEmailNotifier struct{}
 
+// Send mails the message to every address in the comma separated To list.
 func (s SmtpEmailNotifier) Send(emailConfig EmailConfig) error {
+	var recipients []string
+	for _, to := range strings.Split(emailConfig.To, ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			recipients = append(recipients, to)
+		}
+	}
+
 	message := "From: " + emailConfig.From + "\n" +
-		"To: " + emailConfig.To + "\n" +
+		"To: " + strings.Join(recipients, ", ") + "\n" +
 		"Subject: " + emailConfig.Subject + "\n\n" +
 		emailConfig.Body
 
 	err := smtp.SendMail(emailConfig.SmtpServer+":"+emailConfig.SmtpPort,
 		smtp.PlainAuth("", emailConfig.Username, emailConfig.Password, emailConfig.SmtpServer),
-		emailConfig.From, []string{emailConfig.To}, []byte(message))
+		emailConfig.From, recipients, []byte(message))
 
 	if err != nil {
 		return fmt.Errorf("Error sending email: %v", err)
@@ -0,0 +1,84 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	jsonOutput bool
+	// reportWriter receives the JSON document of the command, the process
+	// stdout before setupOutput redirected the progress messages.
+	reportWriter io.Writer = os.Stdout
+)
+
+type errorReport struct {
+	Error    string `json:"error"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// setupOutput applies the --output flag. In json mode stdout only carries
+// the JSON document, everything printed along the way goes to stderr.
+func setupOutput(format string) error {
+	switch format {
+	case "text":
+		if os.Getenv("NO_COLOR") != "" || !isTerminal(os.Stdout) {
+			disableColors()
+		}
+	case "json":
+		jsonOutput = true
+		reportWriter = os.Stdout
+		os.Stdout = os.Stderr
+		disableColors()
+	default:
+		return fmt.Errorf("unknown output format %q, expected text or json", format)
+	}
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func disableColors() {
+	Reset, Red, Green, Yellow, Blue, Bold = "", "", "", "", "", ""
+}
+
+// writeReport prints the result of a command as JSON when --output json is
+// used.
+func writeReport(v any) {
+	if !jsonOutput {
+		return
+	}
+	enc := json.NewEncoder(reportWriter)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing report: %v\n", err)
+	}
+}
+
+// fail prints an error message, reports it in json mode and returns code.
+func fail(code int, format string, args ...any) int {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Println(msg)
+	writeReport(errorReport{Error: msg, ExitCode: code})
+	return code
+}
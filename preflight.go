@@ -0,0 +1,149 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// preflightTimeout bounds the checks which talk to other services.
+const preflightTimeout = 30 * time.Second
+
+// isMountpoint reports whether path is the mount point of a file system,
+// from /proc/self/mountinfo or, where that is not available, by comparing
+// the device with the parent directory.
+func isMountpoint(path string) (bool, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	if file, err := os.Open("/proc/self/mountinfo"); err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) > 4 && unescapeMountinfo(fields[4]) == path {
+				return true, nil
+			}
+		}
+		return false, scanner.Err()
+	}
+
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(filepath.Dir(path), &parent); err != nil {
+		return false, err
+	}
+	return st.Dev != parent.Dev || path == "/", nil
+}
+
+// unescapeMountinfo decodes the octal escapes such as \040 for a space in
+// the paths of /proc/self/mountinfo.
+func unescapeMountinfo(field string) string {
+	var sb strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if n, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				sb.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(field[i])
+	}
+	return sb.String()
+}
+
+var errEnoughFiles = errors.New("enough files")
+
+// countFiles counts the regular files below the directories, stopping once
+// limit files were found.
+func countFiles(dirs []string, limit int) (int, error) {
+	count := 0
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.Type().IsRegular() {
+				count++
+				if count >= limit {
+					return errEnoughFiles
+				}
+			}
+			return nil
+		})
+		if err == errEnoughFiles {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// runCheck runs a command for a preflight check, returning the last line
+// of its error output on failure.
+func runCheck(name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), preflightTimeout)
+	defer cancel()
+	var stderr strings.Builder
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s timed out after %s", name, preflightTimeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return errors.New(lastLine(msg))
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// commandOutput runs a command which sets up or tears down the source of a
+// backup and returns its output. Errors carry the last line of stderr.
+func commandOutput(name string, args ...string) (string, error) {
+	var stdout, stderr strings.Builder
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%s: %s", name, lastLine(msg))
+		}
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,100 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type RestoreResult struct {
+	Job      string  `json:"job"`
+	Snapshot string  `json:"snapshot"`
+	Command  string  `json:"command"`
+	Seconds  float64 `json:"seconds"`
+	Error    string  `json:"error,omitempty"`
+	ExitCode int     `json:"exit_code"`
+}
+
+// restoreDump streams the dump of a job out of a snapshot with restic dump
+// into the job's restore command. The output of both is passed through.
+func restoreDump(config Config, commandKey, snapshot string, extra []string, logger *slog.Logger) RestoreResult {
+	result := RestoreResult{Job: commandKey, Snapshot: snapshot}
+	job, ok := config.Jobs[commandKey].(restorableJob)
+	if !ok {
+		result.Error = fmt.Sprintf("%s cannot be restored by resticara, use restic restore", commandKey)
+		result.ExitCode = exitConfigError
+		fmt.Println(result.Error)
+		return result
+	}
+	settings := config.Jobs[commandKey].Settings()
+	file, restore := job.RestoreCommand(extra)
+
+	dump := []string{"restic", "-r", settings.Bucket, "dump", "--tag", "resticara," + settings.Key}
+	if host := settings.snapshotHost(); host != "" {
+		dump = append(dump, "--host", host)
+	}
+	dump = append(dump, snapshot, file)
+
+	var quoted []string
+	for _, arg := range append(append(dump, "|"), restore...) {
+		if arg == "|" {
+			quoted = append(quoted, arg)
+		} else {
+			quoted = append(quoted, shellQuote(arg))
+		}
+	}
+	result.Command = strings.Join(quoted, " ")
+	fmt.Printf("Restoring %s from snapshot %s\n$ %s\n", commandKey, snapshot, result.Command)
+
+	c1 := exec.Command(dump[0], dump[1:]...)
+	c1.Env = append(os.Environ(), resticEnv(settings)...)
+	c1.Stderr = os.Stderr
+	c2 := exec.Command(restore[0], restore[1:]...)
+	c2.Stdout = os.Stdout
+	c2.Stderr = os.Stderr
+
+	start := time.Now()
+	var err1, err2 error
+	if c2.Stdin, err1 = c1.StdoutPipe(); err1 == nil {
+		if err2 = c2.Start(); err2 == nil {
+			// restic gets SIGPIPE when the restore command exits early
+			err1 = c1.Run()
+			err2 = c2.Wait()
+		}
+	}
+	result.Seconds = time.Since(start).Seconds()
+
+	switch {
+	case err1 != nil:
+		result.Error = fmt.Sprintf("restic dump: %v", err1)
+	case err2 != nil:
+		result.Error = fmt.Sprintf("%s: %v", restore[0], err2)
+	}
+	if result.Error != "" {
+		fmt.Printf("%sRestore of %s failed: %s%s\n", Red, commandKey, result.Error, Reset)
+		logger.Error("restore failed", "job", commandKey, "snapshot", snapshot, "status", "failed", "error", result.Error)
+		result.ExitCode = exitFailure
+		return result
+	}
+	fmt.Printf("%sRestore of %s finished%s\n", Green, commandKey, Reset)
+	logger.Info("restore finished", "job", commandKey, "snapshot", snapshot, "status", "success", "duration", time.Since(start))
+	return result
+}
@@ -0,0 +1,238 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mountEntry is a mounted file system from /proc/self/mountinfo.
+type mountEntry struct {
+	MountPoint string
+	FSType     string
+	Source     string
+}
+
+// findMount returns the file system holding path, which must be absolute
+// and free of symlinks.
+func findMount(path string) (mountEntry, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return mountEntry{}, err
+	}
+	defer file.Close()
+
+	var best mountEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// the optional fields end with a single "-", followed by the file
+		// system type and the mount source
+		fields := strings.Fields(scanner.Text())
+		sep := indexOf(fields, "-")
+		if len(fields) < 5 || sep < 0 || sep+2 >= len(fields) {
+			continue
+		}
+		mountPoint := unescapeMountinfo(fields[4])
+		rel, err := filepath.Rel(mountPoint, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		// later entries with the same mount point are mounted on top
+		if len(mountPoint) >= len(best.MountPoint) {
+			best = mountEntry{MountPoint: mountPoint, FSType: fields[sep+1], Source: unescapeMountinfo(fields[sep+2])}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return mountEntry{}, err
+	}
+	if best.MountPoint == "" {
+		return best, fmt.Errorf("no file system found for %s", path)
+	}
+	return best, nil
+}
+
+// snapshotProvider takes read-only snapshots of whole file systems. Create
+// returns the directory where the root of the snapshot of m is visible and
+// a function removing the snapshot again.
+type snapshotProvider interface {
+	Create(m mountEntry, label string) (string, func() error, error)
+	// Tools lists the commands the provider needs.
+	Tools() []string
+}
+
+// snapshotProviders maps the values of the snapshot key to the providers.
+var snapshotProviders = map[string]func(j *DirJob) snapshotProvider{
+	"lvm":   func(j *DirJob) snapshotProvider { return lvmSnapshots{size: j.SnapshotSize} },
+	"btrfs": func(j *DirJob) snapshotProvider { return btrfsSnapshots{} },
+	"zfs":   func(j *DirJob) snapshotProvider { return zfsSnapshots{} },
+}
+
+// lvmSnapshots creates a copy-on-write snapshot volume and mounts it on a
+// temporary directory.
+type lvmSnapshots struct {
+	size string
+}
+
+func (lvmSnapshots) Tools() []string {
+	return []string{"lvs", "lvcreate", "lvremove", "mount", "umount"}
+}
+
+func (p lvmSnapshots) Create(m mountEntry, label string) (string, func() error, error) {
+	out, err := commandOutput("lvs", "--noheadings", "-o", "vg_name,lv_name", m.Source)
+	if err != nil {
+		return "", nil, err
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 {
+		return "", nil, fmt.Errorf("%s on %s is not a logical volume", m.Source, m.MountPoint)
+	}
+	volume := fields[0] + "/" + fields[1] + "-resticara-" + label
+	if _, err := commandOutput("lvcreate", "--snapshot", "--name", fields[1]+"-resticara-"+label, "--size", p.size, fields[0]+"/"+fields[1]); err != nil {
+		return "", nil, err
+	}
+	remove := func() error {
+		_, err := commandOutput("lvremove", "--force", volume)
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "resticara-snapshot-")
+	if err != nil {
+		return "", nil, errors.Join(err, remove())
+	}
+	options := "ro"
+	if m.FSType == "xfs" {
+		// the snapshot has the same file system UUID as its origin
+		options += ",nouuid"
+	}
+	if _, err := commandOutput("mount", "-o", options, "/dev/"+volume, dir); err != nil {
+		return "", nil, errors.Join(err, os.Remove(dir), remove())
+	}
+	return dir, func() error {
+		if _, err := commandOutput("umount", dir); err != nil {
+			return err
+		}
+		return errors.Join(os.Remove(dir), remove())
+	}, nil
+}
+
+// btrfsSnapshots creates a read-only snapshot of the subvolume mounted at
+// the mount point. A snapshot has to stay on its file system, so it is a
+// subvolume of its own at the top of the mount point, which leaves nothing
+// behind once it is deleted.
+type btrfsSnapshots struct{}
+
+// btrfsSnapshotPrefix starts the name of the btrfs snapshots, followed by
+// the label.
+const btrfsSnapshotPrefix = ".resticara-snapshot-"
+
+func (btrfsSnapshots) Tools() []string {
+	return []string{"btrfs"}
+}
+
+func (btrfsSnapshots) Create(m mountEntry, label string) (string, func() error, error) {
+	if m.FSType != "btrfs" {
+		return "", nil, fmt.Errorf("%s is a %s file system, not btrfs", m.MountPoint, m.FSType)
+	}
+	path := filepath.Join(m.MountPoint, btrfsSnapshotPrefix+label)
+	if _, err := commandOutput("btrfs", "subvolume", "snapshot", "-r", m.MountPoint, path); err != nil {
+		return "", nil, err
+	}
+	return path, func() error {
+		_, err := commandOutput("btrfs", "subvolume", "delete", path)
+		return err
+	}, nil
+}
+
+// zfsSnapshots snapshots the dataset, which is visible read-only below
+// .zfs/snapshot of its mount point.
+type zfsSnapshots struct{}
+
+func (zfsSnapshots) Tools() []string {
+	return []string{"zfs"}
+}
+
+func (zfsSnapshots) Create(m mountEntry, label string) (string, func() error, error) {
+	if m.FSType != "zfs" {
+		return "", nil, fmt.Errorf("%s is a %s file system, not zfs", m.MountPoint, m.FSType)
+	}
+	name := "resticara-" + label
+	if _, err := commandOutput("zfs", "snapshot", m.Source+"@"+name); err != nil {
+		return "", nil, err
+	}
+	return filepath.Join(m.MountPoint, ".zfs", "snapshot", name), func() error {
+		_, err := commandOutput("zfs", "destroy", m.Source+"@"+name)
+		return err
+	}, nil
+}
+
+// bindSnapshots runs the command in a private mount namespace in which
+// every directory is replaced by a read-only bind mount of its snapshot, so
+// restic records the original paths. binds holds pairs of snapshot path and
+// original directory.
+func bindSnapshots(binds []string, command []string) []string {
+	script := strings.Repeat(`mount --bind "$1" "$2" && mount -o remount,bind,ro "$2" && shift 2 && `, len(binds)/2) + `exec "$@"`
+	args := []string{"unshare", "--mount", "--propagation", "private", "--", "/bin/sh", "-c", script, "resticara"}
+	return append(append(args, binds...), command...)
+}
+
+// snapshotDirectories takes a snapshot of every file system holding one of
+// the directories, as found by lookup, and returns the pairs for
+// bindSnapshots. The returned teardown removes the snapshots again and must
+// be called even on errors.
+func snapshotDirectories(provider snapshotProvider, lookup func(string) (mountEntry, error), directories []string, label string) ([]string, func() error, error) {
+	var teardowns []func() error
+	teardown := func() error {
+		var errs []error
+		for i := len(teardowns) - 1; i >= 0; i-- {
+			errs = append(errs, teardowns[i]())
+		}
+		return errors.Join(errs...)
+	}
+
+	roots := make(map[string]string)
+	var binds []string
+	for _, dir := range directories {
+		path, err := filepath.Abs(dir)
+		if err == nil {
+			path, err = filepath.EvalSymlinks(path)
+		}
+		if err != nil {
+			return nil, teardown, err
+		}
+		m, err := lookup(path)
+		if err != nil {
+			return nil, teardown, err
+		}
+		root, ok := roots[m.MountPoint]
+		if !ok {
+			var remove func() error
+			root, remove, err = provider.Create(m, label)
+			if err != nil {
+				return nil, teardown, fmt.Errorf("snapshot of %s: %v", m.MountPoint, err)
+			}
+			roots[m.MountPoint] = root
+			teardowns = append(teardowns, remove)
+		}
+		rel, _ := filepath.Rel(m.MountPoint, path)
+		binds = append(binds, filepath.Join(root, rel), path)
+	}
+	return binds, teardown, nil
+}
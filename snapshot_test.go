@@ -0,0 +1,189 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeSnapshots records the snapshots it creates and removes, and fails to
+// snapshot the mount points in fail.
+type fakeSnapshots struct {
+	created []string
+	removed []string
+	fail    map[string]bool
+}
+
+func (p *fakeSnapshots) Tools() []string {
+	return nil
+}
+
+func (p *fakeSnapshots) Create(m mountEntry, label string) (string, func() error, error) {
+	if p.fail[m.MountPoint] {
+		return "", nil, errors.New("no space left")
+	}
+	p.created = append(p.created, m.MountPoint)
+	return filepath.Join("/snapshots", filepath.Base(m.MountPoint), label), func() error {
+		p.removed = append(p.removed, m.MountPoint)
+		return nil
+	}, nil
+}
+
+// fakeMounts returns a lookup treating every given directory as a mount
+// point.
+func fakeMounts(mountPoints ...string) func(string) (mountEntry, error) {
+	return func(path string) (mountEntry, error) {
+		for _, mp := range mountPoints {
+			if path == mp || strings.HasPrefix(path, mp+"/") {
+				return mountEntry{MountPoint: mp, FSType: "fake"}, nil
+			}
+		}
+		return mountEntry{}, errors.New("not mounted")
+	}
+}
+
+func snapshotTree(t *testing.T) string {
+	t.Helper()
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"a/x", "a/y", "b/z", "c"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return base
+}
+
+func TestSnapshotDirectories(t *testing.T) {
+	base := snapshotTree(t)
+	a, b, c := filepath.Join(base, "a"), filepath.Join(base, "b"), filepath.Join(base, "c")
+	provider := &fakeSnapshots{}
+
+	binds, teardown, err := snapshotDirectories(provider, fakeMounts(a, b, c),
+		[]string{filepath.Join(a, "x"), filepath.Join(b, "z"), filepath.Join(a, "y")}, "label")
+	if err != nil {
+		t.Fatalf("snapshotDirectories() error = %v", err)
+	}
+	want := []string{
+		"/snapshots/a/label/x", filepath.Join(a, "x"),
+		"/snapshots/b/label/z", filepath.Join(b, "z"),
+		"/snapshots/a/label/y", filepath.Join(a, "y"),
+	}
+	if !reflect.DeepEqual(binds, want) {
+		t.Errorf("binds = %q, want %q", binds, want)
+	}
+	if !reflect.DeepEqual(provider.created, []string{a, b}) {
+		t.Errorf("created = %q, want one snapshot per mount point", provider.created)
+	}
+
+	if err := teardown(); err != nil {
+		t.Fatalf("teardown() error = %v", err)
+	}
+	if !reflect.DeepEqual(provider.removed, []string{b, a}) {
+		t.Errorf("removed = %q, want %q", provider.removed, []string{b, a})
+	}
+}
+
+func TestSnapshotDirectoriesFailingCreate(t *testing.T) {
+	base := snapshotTree(t)
+	a, b, c := filepath.Join(base, "a"), filepath.Join(base, "b"), filepath.Join(base, "c")
+	provider := &fakeSnapshots{fail: map[string]bool{c: true}}
+
+	_, teardown, err := snapshotDirectories(provider, fakeMounts(a, b, c),
+		[]string{filepath.Join(a, "x"), filepath.Join(b, "z"), c}, "label")
+	if err == nil || !strings.Contains(err.Error(), "snapshot of "+c) {
+		t.Fatalf("snapshotDirectories() error = %v, want the failure of %s", err, c)
+	}
+	if err := teardown(); err != nil {
+		t.Fatalf("teardown() error = %v", err)
+	}
+	if !reflect.DeepEqual(provider.removed, []string{b, a}) {
+		t.Errorf("removed = %q, want %q", provider.removed, []string{b, a})
+	}
+}
+
+func TestSnapshotDirectoriesMissingDirectory(t *testing.T) {
+	base := snapshotTree(t)
+	a := filepath.Join(base, "a")
+	provider := &fakeSnapshots{}
+
+	_, teardown, err := snapshotDirectories(provider, fakeMounts(a),
+		[]string{filepath.Join(a, "x"), filepath.Join(base, "missing")}, "label")
+	if err == nil {
+		t.Fatal("snapshotDirectories() succeeded for a missing directory")
+	}
+	teardown()
+	if !reflect.DeepEqual(provider.removed, []string{a}) {
+		t.Errorf("removed = %q, want %q", provider.removed, []string{a})
+	}
+}
+
+func TestBindSnapshots(t *testing.T) {
+	got := bindSnapshots([]string{"/snap/www", "/var/www", "/snap/etc", "/etc"}, []string{"restic", "backup", "/var/www", "/etc"})
+	want := []string{"unshare", "--mount", "--propagation", "private", "--", "/bin/sh", "-c",
+		`mount --bind "$1" "$2" && mount -o remount,bind,ro "$2" && shift 2 && ` +
+			`mount --bind "$1" "$2" && mount -o remount,bind,ro "$2" && shift 2 && exec "$@"`,
+		"resticara", "/snap/www", "/var/www", "/snap/etc", "/etc", "restic", "backup", "/var/www", "/etc"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("bindSnapshots() = %q, want %q", got, want)
+	}
+}
+
+func TestSnapshotHardening(t *testing.T) {
+	tests := []struct {
+		name     string
+		general  string
+		job      string
+		rejected bool
+	}{
+		{"global hardening", "systemd_hardening = true", "", true},
+		{"job hardening", "", "systemd_hardening = true", true},
+		{"job opts out", "systemd_hardening = true", "systemd_hardening = false", false},
+		{"no hardening", "", "", false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.ini")
+		content := "[general]\n" + tt.general + "\n[smtp]\nenabled = false\n" +
+			"[dir:www]\nbucket = /srv/repo\nretention_daily = 7\nretention_weekly = 4\nretention_monthly = 6\n" +
+			"directory = /var/www\nsnapshot = lvm\n" + tt.job + "\n"
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := readConfig(path)
+		if tt.rejected != (err != nil && strings.Contains(err.Error(), "systemd_hardening")) {
+			t.Errorf("%s: readConfig() error = %v, rejected %t", tt.name, err, tt.rejected)
+		}
+		rejected := false
+		for _, issue := range validateConfig(path).Issues {
+			if issue.Severity == "error" && issue.Key == "snapshot" {
+				rejected = true
+			} else if issue.Severity == "error" {
+				t.Errorf("%s: unexpected issue %+v", tt.name, issue)
+			}
+		}
+		if rejected != tt.rejected {
+			t.Errorf("%s: config validate rejected %t, want %t", tt.name, rejected, tt.rejected)
+		}
+	}
+}
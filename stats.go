@@ -0,0 +1,227 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dataAddedRe = regexp.MustCompile(`Added to the repo(?:sitory)?:\s+([0-9.]+)\s+(B|KiB|MiB|GiB|TiB)`)
+
+var byteUnits = map[string]int64{
+	"B": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40,
+	"": 1, "b": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30, "t": 1 << 40,
+}
+
+// parseDataAdded extracts the amount of data a restic backup added to the
+// repository from its summary.
+func parseDataAdded(output string) (int64, bool) {
+	m := dataAddedRe.FindStringSubmatch(output)
+	if m == nil {
+		return 0, false
+	}
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return int64(value * float64(byteUnits[m[2]])), true
+}
+
+// parseByteSize parses sizes written like the restic options, such as 500M
+// or 2G, with binary units.
+func parseByteSize(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if !byteSizeRe.MatchString(value) {
+		return 0, fmt.Errorf("must be a size such as 500M or 2G")
+	}
+	unit := strings.ToLower(strings.TrimLeft(value, "0123456789"))
+	n, err := strconv.ParseInt(strings.TrimRight(value, "bkmgtBKMGT"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("must be a size such as 500M or 2G")
+	}
+	return n * byteUnits[unit], nil
+}
+
+func formatBytes(n int64) string {
+	units := []string{"TiB", "GiB", "MiB", "KiB"}
+	for _, unit := range units {
+		if n >= byteUnits[unit] {
+			return fmt.Sprintf("%.1f %s", float64(n)/float64(byteUnits[unit]), unit)
+		}
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// runStats records the size of one backup run of a job.
+type runStats struct {
+	Time          time.Time `json:"time"`
+	DataAdded     int64     `json:"data_added"`
+	SnapshotSize  int64     `json:"snapshot_size,omitempty"`
+	SnapshotFiles int64     `json:"snapshot_files,omitempty"`
+}
+
+// stateDir returns the directory for the run history, /var/lib/resticara
+// for root and the state directory of the user otherwise.
+func stateDir() string {
+	if os.Geteuid() == 0 {
+		return "/var/lib/resticara"
+	}
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "resticara")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".local/state/resticara")
+}
+
+func historyPath(commandKey string) string {
+	return filepath.Join(stateDir(), "history", sanitizeName(commandKey)+".json")
+}
+
+// loadHistory returns the recorded runs of a job, oldest first. A missing
+// history is not an error.
+func loadHistory(commandKey string) ([]runStats, error) {
+	content, err := os.ReadFile(historyPath(commandKey))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var history []runStats
+	if err := json.Unmarshal(content, &history); err != nil {
+		return nil, fmt.Errorf("%s: %v", historyPath(commandKey), err)
+	}
+	return history, nil
+}
+
+// saveHistory appends a run to the history of a job, keeping the last keep
+// runs.
+func saveHistory(commandKey string, history []runStats, run runStats, keep int) error {
+	history = append(history, run)
+	if len(history) > keep {
+		history = history[len(history)-keep:]
+	}
+	content, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := historyPath(commandKey)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// snapshotStats returns the restored size and file count of a snapshot.
+func snapshotStats(runner DefaultCommandRunner, settings *JobSettings, snapshotID string) (int64, int64, error) {
+	success, stdout, stderr := runner.Run(pipeline{Restic: []string{"restic", "-r", settings.Bucket, "stats", "--json", snapshotID}}, resticEnv(settings))
+	if !success {
+		return 0, 0, fmt.Errorf("restic stats failed: %s", lastLine(stderr))
+	}
+	var stats struct {
+		TotalSize      int64 `json:"total_size"`
+		TotalFileCount int64 `json:"total_file_count"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimSpace(stdout)), &stats); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse restic stats output: %v", err)
+	}
+	return stats.TotalSize, stats.TotalFileCount, nil
+}
+
+// minHistory is the number of previous runs needed before
+// alert_change_percent is checked.
+const minHistory = 3
+
+// growthAlerts compares the data added by a run with the thresholds of the
+// job and the average of the previous runs.
+func growthAlerts(settings *JobSettings, history []runStats, added int64) []string {
+	var alerts []string
+	if settings.AlertMinAdded != nil && added < *settings.AlertMinAdded {
+		alerts = append(alerts, fmt.Sprintf("added %s, less than alert_min_added of %s; is the source empty or not mounted?",
+			formatBytes(added), formatBytes(*settings.AlertMinAdded)))
+	}
+	if settings.AlertMaxAdded != nil && added > *settings.AlertMaxAdded {
+		alerts = append(alerts, fmt.Sprintf("added %s, more than alert_max_added of %s",
+			formatBytes(added), formatBytes(*settings.AlertMaxAdded)))
+	}
+	if settings.AlertChangePercent > 0 && len(history) >= minHistory {
+		window := history
+		if len(window) > settings.AlertHistory {
+			window = window[len(window)-settings.AlertHistory:]
+		}
+		var sum int64
+		for _, run := range window {
+			sum += run.DataAdded
+		}
+		average := float64(sum) / float64(len(window))
+		if average > 0 {
+			change := (float64(added) - average) / average * 100
+			if change > float64(settings.AlertChangePercent) || change < -float64(settings.AlertChangePercent) {
+				alerts = append(alerts, fmt.Sprintf("added %s, %+.0f%% compared to the average of %s over the last %d runs",
+					formatBytes(added), change, formatBytes(int64(average)), len(window)))
+			}
+		}
+	}
+	return alerts
+}
+
+// checkGrowth records the size of a successful backup in commandInfo and in
+// the job's history, and adds the growth alerts. It reports whether any
+// alert was raised.
+func checkGrowth(commandInfo *CommandInfo, runner DefaultCommandRunner, settings *JobSettings, logger *slog.Logger) bool {
+	added, ok := parseDataAdded(commandInfo.BackupOutput)
+	if !ok {
+		logger.Warn("could not determine the data added by the backup", "job", settings.Key)
+		return false
+	}
+	run := runStats{Time: time.Now(), DataAdded: added}
+	commandInfo.DataAdded = added
+	if snapshotID := parseSnapshotID(commandInfo.BackupOutput); snapshotID != "" {
+		size, files, err := snapshotStats(runner, settings, snapshotID)
+		if err != nil {
+			logger.Warn("snapshot statistics failed", "job", settings.Key, "error", err)
+		} else {
+			run.SnapshotSize, run.SnapshotFiles = size, files
+			commandInfo.SnapshotSize, commandInfo.SnapshotFiles = size, files
+		}
+	}
+
+	history, err := loadHistory(settings.Key)
+	if err != nil {
+		// start a new history rather than failing the backup
+		logger.Warn("failed to read the run history", "job", settings.Key, "error", err)
+	}
+	commandInfo.Alerts = growthAlerts(settings, history, added)
+	for _, alert := range commandInfo.Alerts {
+		fmt.Printf("%sAlert for %s: %s%s\n", Yellow, settings.Key, alert, Reset)
+		logger.Warn("backup size alert", "job", settings.Key, "data_added", added, "alert", alert)
+	}
+	if err := saveHistory(settings.Key, history, run, settings.AlertHistory); err != nil {
+		logger.Warn("failed to write the run history", "job", settings.Key, "error", err)
+	}
+	return len(commandInfo.Alerts) > 0
+}
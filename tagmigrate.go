@@ -0,0 +1,124 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// legacyJob is implemented by the job types which existed before snapshots
+// were tagged, so their untagged snapshots can be found by path.
+type legacyJob interface {
+	// LegacyPaths returns the paths restic recorded for the job's snapshots.
+	LegacyPaths() []string
+}
+
+func (j *DirJob) LegacyPaths() []string {
+	var paths []string
+	for _, dir := range j.Directories {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		paths = append(paths, dir)
+	}
+	return paths
+}
+
+func (j *MySQLJob) LegacyPaths() []string {
+	return []string{"/" + j.Database + ".sql"}
+}
+
+type TagResult struct {
+	Job       string   `json:"job"`
+	Snapshots []string `json:"snapshots"`
+	Seconds   float64  `json:"seconds"`
+	Error     string   `json:"error,omitempty"`
+	ExitCode  int      `json:"exit_code"`
+}
+
+// tagLegacySnapshots adds the tags of a job to its snapshots taken before
+// resticara tagged them, so forget applies the job's retention to them.
+// Snapshots of this host with the job's paths count as the job's when they
+// do not carry the resticara tag yet.
+func tagLegacySnapshots(config Config, commandKey string, logger *slog.Logger) TagResult {
+	result := TagResult{Job: commandKey}
+	job, ok := config.Jobs[commandKey].(legacyJob)
+	if !ok {
+		fmt.Printf("%s has no snapshots from before tagging\n", commandKey)
+		return result
+	}
+	settings := config.Jobs[commandKey].Settings()
+	runner := DefaultCommandRunner{}
+	env := resticEnv(settings)
+	start := time.Now()
+	fail := func(format string, args ...any) TagResult {
+		result.Error = fmt.Sprintf(format, args...)
+		result.ExitCode = exitFailure
+		result.Seconds = time.Since(start).Seconds()
+		fmt.Printf("%sTagging the snapshots of %s failed: %s%s\n", Red, commandKey, result.Error, Reset)
+		logger.Error("tagging failed", "job", commandKey, "repo", settings.Bucket, "status", "failed", "error", result.Error)
+		return result
+	}
+
+	// restic backup recorded the hostname, as no --host was given
+	args := []string{"restic", "-r", settings.Bucket, "snapshots", "--json"}
+	if host, err := os.Hostname(); err == nil {
+		args = append(args, "--host", host)
+	}
+	for _, path := range job.LegacyPaths() {
+		args = append(args, "--path", path)
+	}
+	success, stdout, stderr := runner.Run(pipeline{Restic: args}, env)
+	if !success {
+		return fail("%s", lastLine(stderr))
+	}
+	var snapshots []struct {
+		ID   string   `json:"id"`
+		Tags []string `json:"tags"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &snapshots); err != nil {
+		return fail("parsing restic snapshots: %v", err)
+	}
+	for _, snapshot := range snapshots {
+		if !slices.Contains(snapshot.Tags, "resticara") {
+			result.Snapshots = append(result.Snapshots, snapshot.ID)
+		}
+	}
+	if len(result.Snapshots) == 0 {
+		fmt.Printf("No untagged snapshots of %s found\n", commandKey)
+		result.Seconds = time.Since(start).Seconds()
+		return result
+	}
+
+	args = []string{"restic", "-r", settings.Bucket, "tag"}
+	for _, tag := range settings.snapshotTags() {
+		args = append(args, "--add", tag)
+	}
+	success, _, stderr = runner.Run(pipeline{Restic: append(args, result.Snapshots...)}, env)
+	if !success {
+		return fail("%s", lastLine(stderr))
+	}
+	result.Seconds = time.Since(start).Seconds()
+	fmt.Printf("%sTagged %d snapshots of %s%s\n", Green, len(result.Snapshots), commandKey, Reset)
+	logger.Info("snapshots tagged", "job", commandKey, "repo", settings.Bucket, "snapshots", len(result.Snapshots), "status", "success")
+	return result
+}
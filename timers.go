@@ -0,0 +1,559 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type timerOptions struct {
+	DryRun     bool
+	OutputDir  string
+	NoActivate bool
+	User       bool
+	Binary     string
+	ConfigPath string
+}
+
+func (opts timerOptions) systemctl(args ...string) *exec.Cmd {
+	if opts.User {
+		args = append([]string{"--user"}, args...)
+	}
+	return exec.Command("systemctl", args...)
+}
+
+func (opts timerOptions) execStart(args string) string {
+	return fmt.Sprintf("%s %s %s", systemdQuote(opts.Binary), systemdQuote("--config="+opts.ConfigPath), args)
+}
+
+func systemdQuote(arg string) string {
+	if !strings.ContainsAny(arg, " \t\"'\\") {
+		return arg
+	}
+	return strconv.Quote(arg)
+}
+
+type unitFile struct {
+	Name    string
+	Content string
+}
+
+type timerPlan struct {
+	Created   []unitFile
+	Changed   []unitFile
+	Unchanged []unitFile
+	Removed   []string
+}
+
+func userUnitDir() (string, error) {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("could not determine home directory: %v", err)
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "systemd", "user"), nil
+}
+
+func systemdUnitDir() (string, error) {
+	unitOut, err := exec.Command("systemctl", "show", "--property=UnitPath").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve systemd unit path: %v", err)
+	}
+	unitLine := strings.TrimSpace(string(unitOut))
+	unitLine = strings.TrimPrefix(unitLine, "UnitPath=")
+	paths := strings.FieldsFunc(unitLine, func(r rune) bool { return r == ':' || r == ' ' })
+	for _, p := range paths {
+		if p == "/etc/systemd/system" {
+			if _, err := os.Stat(p); err == nil {
+				return p, nil
+			}
+		}
+	}
+	for _, p := range paths {
+		if p == "" {
+			continue
+		}
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("could not determine systemd unit directory from UnitPath: %s", unitLine)
+}
+
+// localRepoPath returns the filesystem path of a local restic repository,
+// or an empty string for remote backends.
+func localRepoPath(repo string) string {
+	if strings.HasPrefix(repo, "local:") {
+		return strings.TrimPrefix(repo, "local:")
+	}
+	if strings.HasPrefix(repo, "/") {
+		return repo
+	}
+	return ""
+}
+
+// serviceExtras returns the additional [Unit] and [Service] directives for
+// a job: OnFailure= notification and, when enabled, sandboxing derived from
+// the directories the job reads and the repositories it writes to.
+// jobHardening reports whether the units of a job are sandboxed, by the
+// job's own systemd_hardening or else the one under [general].
+func jobHardening(config Config, settings *JobSettings) bool {
+	if settings.Hardening != nil {
+		return *settings.Hardening
+	}
+	return config.Hardening
+}
+
+func serviceExtras(config Config, settings *JobSettings, opts timerOptions, readPaths []string) (string, string) {
+	unit := instanceMarker(config)
+	var service string
+	if config.NotifyOnFailure {
+		unit += fmt.Sprintf("OnFailure=%snotify@%%n.service\n", unitPrefix(config))
+	}
+
+	if !jobHardening(config, settings) {
+		return unit, service
+	}
+
+	service += "ProtectSystem=strict\n"
+	service += "ProtectHome=read-only\n"
+	service += "PrivateTmp=true\n"
+	service += "NoNewPrivileges=true\n"
+	if !opts.User {
+		service += "CapabilityBoundingSet=CAP_DAC_READ_SEARCH\n"
+	}
+	service += "CacheDirectory=resticara\n"
+	service += "StateDirectory=resticara\n"
+	// the job locks, kept when the unit stops as other units share them
+	service += "RuntimeDirectory=resticara\n"
+	service += "RuntimeDirectoryPreserve=yes\n"
+	service += "Environment=RESTIC_CACHE_DIR=%C/resticara\n"
+	for _, p := range readPaths {
+		if p != "" {
+			service += fmt.Sprintf("ReadOnlyPaths=%s\n", systemdQuote("-"+p))
+		}
+	}
+	for _, bucket := range jobRepositories(config, settings) {
+		if repo := localRepoPath(bucket); repo != "" {
+			service += fmt.Sprintf("ReadWritePaths=%s\n", systemdQuote("-"+repo))
+		}
+	}
+	nice := 10
+	if settings.Nice != nil {
+		nice = *settings.Nice
+	}
+	service += fmt.Sprintf("Nice=%d\n", nice)
+	ioClass := settings.IOSchedulingClass
+	if ioClass == "" {
+		ioClass = "idle"
+	}
+	service += fmt.Sprintf("IOSchedulingClass=%s\n", ioClass)
+	if settings.CPUQuota != "" {
+		service += fmt.Sprintf("CPUQuota=%s\n", settings.CPUQuota)
+	}
+	if settings.MemoryMax != "" {
+		service += fmt.Sprintf("MemoryMax=%s\n", settings.MemoryMax)
+	}
+	return unit, service
+}
+
+// unitPrefix returns the prefix of all unit names of the configured instance.
+func unitPrefix(config Config) string {
+	if config.Instance == "" {
+		return "resticara-"
+	}
+	return "resticara-" + config.Instance + "-"
+}
+
+const instanceMarkerKey = "X-Resticara-Instance="
+
+// instanceMarker tags the units of a named instance so that gentimer only
+// cleans up the units it owns. Units of the default instance stay unmarked.
+func instanceMarker(config Config) string {
+	if config.Instance == "" {
+		return ""
+	}
+	return instanceMarkerKey + config.Instance + "\n"
+}
+
+func unitInstance(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		if val, ok := strings.CutPrefix(strings.TrimSpace(line), instanceMarkerKey); ok {
+			return val
+		}
+	}
+	return ""
+}
+
+func renderNotifyUnit(config Config, opts timerOptions) unitFile {
+	args := "notify-failure %i"
+	if opts.User {
+		args = "notify-failure --user %i"
+	}
+	return unitFile{Name: unitPrefix(config) + "notify@.service", Content: fmt.Sprintf(`[Unit]
+Description=Resticara failure notification for %%i
+%s
+[Service]
+Type=oneshot
+ExecStart=%s
+`, instanceMarker(config), opts.execStart(args))}
+}
+
+// prunePolicy returns how often a job's repository is pruned, either as a
+// day count or as a schedule. The most specific setting wins: a per-job
+// schedule or day count overrides the ones from [general].
+func prunePolicy(config Config, settings *JobSettings) (int, string) {
+	pruneDays := config.RetentionPrune
+	pruneSchedule := config.PruneSchedule
+	if settings.RetentionPrune != nil {
+		pruneDays = *settings.RetentionPrune
+		pruneSchedule = ""
+	}
+	if settings.PruneSchedule != "" {
+		pruneSchedule = settings.PruneSchedule
+	}
+	return pruneDays, pruneSchedule
+}
+
+// timerTrigger converts a schedule accepted by parseSchedule into [Timer]
+// directives. Calendar expressions are kept as written, cron expressions are
+// rewritten to their systemd equivalent.
+func timerTrigger(expr string) string {
+	schedule, err := parseSchedule(expr)
+	if err != nil {
+		return fmt.Sprintf("OnCalendar=%s\n", expr)
+	}
+	switch s := schedule.(type) {
+	case intervalSchedule:
+		every := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(expr), "@every"))
+		return fmt.Sprintf("OnBootSec=%s\nOnUnitActiveSec=%s\n", every, every)
+	case *calendarSpec:
+		if strings.HasPrefix(strings.TrimSpace(expr), "@") || len(strings.Fields(expr)) == 5 {
+			return fmt.Sprintf("OnCalendar=%s\n", s.String())
+		}
+	}
+	return fmt.Sprintf("OnCalendar=%s\n", strings.TrimSpace(expr))
+}
+
+// renderUnits returns the service and timer files for every configured
+// command, sorted by file name.
+func renderUnits(config Config, opts timerOptions) []unitFile {
+	wantedBy := "multi-user.target"
+	if opts.User {
+		wantedBy = "default.target"
+	}
+	prefix := unitPrefix(config)
+	marker := instanceMarker(config)
+	var units []unitFile
+	for commandKey, job := range config.Jobs {
+		settings := job.Settings()
+		sanitized := sanitizeName(commandKey)
+		pruneDays, pruneSchedule := prunePolicy(config, settings)
+		backupUnitExtras, backupServiceExtras := serviceExtras(config, settings, opts, job.ReadPaths())
+		pruneUnitExtras, pruneServiceExtras := serviceExtras(config, settings, opts, nil)
+
+		backupService := fmt.Sprintf(`[Unit]
+Description=Resticara backup for %s
+%s
+[Service]
+Type=oneshot
+ExecStart=%s
+SuccessExitStatus=%d %d
+%s
+[Install]
+WantedBy=%s
+`, commandKey, backupUnitExtras, opts.execStart("run "+commandKey), exitNotifyFailed, exitLocked, backupServiceExtras, wantedBy)
+
+		timerSettings := timerTrigger(settings.Schedule)
+		if settings.RandomizedDelay != "" {
+			timerSettings += fmt.Sprintf("RandomizedDelaySec=%s\n", settings.RandomizedDelay)
+		}
+		if settings.Accuracy != "" {
+			timerSettings += fmt.Sprintf("AccuracySec=%s\n", settings.Accuracy)
+		}
+		backupTimer := fmt.Sprintf(`[Unit]
+Description=Resticara backup timer for %s
+%s
+[Timer]
+%sPersistent=true
+
+[Install]
+WantedBy=timers.target
+`, commandKey, marker, timerSettings)
+
+		var repos []string
+		for _, repo := range jobRepositories(config, settings) {
+			repos = append(repos, systemdQuote(repo))
+		}
+		pruneArgs := strings.Join(repos, " ")
+		pruneService := fmt.Sprintf(`[Unit]
+Description=Resticara prune for %s
+%s
+[Service]
+Type=oneshot
+ExecStart=%s
+SuccessExitStatus=%d %d
+%s
+[Install]
+WantedBy=%s
+`, commandKey, pruneUnitExtras, opts.execStart("prune "+pruneArgs), exitNotifyFailed, exitLocked, pruneServiceExtras, wantedBy)
+
+		pruneTrigger := fmt.Sprintf("OnUnitActiveSec=%dd\n", pruneDays)
+		if pruneSchedule != "" {
+			pruneTrigger = timerTrigger(pruneSchedule)
+		}
+		pruneTimer := fmt.Sprintf(`[Unit]
+Description=Resticara prune timer for %s
+%s
+[Timer]
+%sPersistent=true
+
+[Install]
+WantedBy=timers.target
+`, commandKey, marker, pruneTrigger)
+
+		units = append(units,
+			unitFile{Name: fmt.Sprintf("%s%s.service", prefix, sanitized), Content: backupService},
+			unitFile{Name: fmt.Sprintf("%s%s.timer", prefix, sanitized), Content: backupTimer},
+			unitFile{Name: fmt.Sprintf("%s%s-prune.service", prefix, sanitized), Content: pruneService},
+			unitFile{Name: fmt.Sprintf("%s%s-prune.timer", prefix, sanitized), Content: pruneTimer},
+		)
+	}
+	if config.NotifyOnFailure {
+		units = append(units, renderNotifyUnit(config, opts))
+	}
+	sort.Slice(units, func(i, j int) bool { return units[i].Name < units[j].Name })
+	return units
+}
+
+// planTimers compares the rendered units with the files in unitDir. Only
+// units belonging to the configured instance are considered for removal.
+func planTimers(config Config, unitDir string, units []unitFile) (timerPlan, error) {
+	var plan timerPlan
+	expected := make(map[string]struct{})
+	for _, u := range units {
+		expected[u.Name] = struct{}{}
+		current, err := os.ReadFile(filepath.Join(unitDir, u.Name))
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			plan.Created = append(plan.Created, u)
+		case err != nil:
+			return timerPlan{}, err
+		case string(current) != u.Content:
+			plan.Changed = append(plan.Changed, u)
+		default:
+			plan.Unchanged = append(plan.Unchanged, u)
+		}
+	}
+
+	entries, err := os.ReadDir(unitDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return timerPlan{}, err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, unitPrefix(config)) {
+			continue
+		}
+		if !(strings.HasSuffix(name, ".service") || strings.HasSuffix(name, ".timer")) {
+			continue
+		}
+		if _, ok := expected[name]; ok {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(unitDir, name))
+		if err != nil {
+			return timerPlan{}, err
+		}
+		if unitInstance(string(content)) != config.Instance {
+			continue
+		}
+		plan.Removed = append(plan.Removed, name)
+	}
+	return plan, nil
+}
+
+func printTimerPlan(unitDir string, plan timerPlan) {
+	if len(plan.Created)+len(plan.Changed)+len(plan.Removed) == 0 {
+		fmt.Printf("Systemd units in %s are up to date.\n", unitDir)
+		return
+	}
+	for _, u := range plan.Created {
+		fmt.Printf(Green+"create"+Reset+" %s\n", filepath.Join(unitDir, u.Name))
+		fmt.Print(unifiedDiff("/dev/null", filepath.Join(unitDir, u.Name), "", u.Content))
+	}
+	for _, u := range plan.Changed {
+		path := filepath.Join(unitDir, u.Name)
+		current, _ := os.ReadFile(path)
+		fmt.Printf(Yellow+"change"+Reset+" %s\n", path)
+		fmt.Print(unifiedDiff(path, path, string(current), u.Content))
+	}
+	for _, name := range plan.Removed {
+		path := filepath.Join(unitDir, name)
+		current, _ := os.ReadFile(path)
+		fmt.Printf(Red+"remove"+Reset+" %s\n", path)
+		fmt.Print(unifiedDiff(path, "/dev/null", string(current), ""))
+	}
+}
+
+// unifiedDiff renders a line based diff of a and b with full context.
+func unifiedDiff(nameA, nameB, a, b string) string {
+	linesA := strings.SplitAfter(a, "\n")
+	linesB := strings.SplitAfter(b, "\n")
+	if linesA[len(linesA)-1] == "" {
+		linesA = linesA[:len(linesA)-1]
+	}
+	if linesB[len(linesB)-1] == "" {
+		linesB = linesB[:len(linesB)-1]
+	}
+
+	// Longest common subsequence table, lcs[i][j] covers linesA[i:] and linesB[j:].
+	lcs := make([][]int, len(linesA)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(linesB)+1)
+	}
+	for i := len(linesA) - 1; i >= 0; i-- {
+		for j := len(linesB) - 1; j >= 0; j-- {
+			if linesA[i] == linesB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", nameA, nameB)
+	i, j := 0, 0
+	for i < len(linesA) || j < len(linesB) {
+		switch {
+		case i < len(linesA) && j < len(linesB) && linesA[i] == linesB[j]:
+			sb.WriteString(" " + strings.TrimSuffix(linesA[i], "\n") + "\n")
+			i++
+			j++
+		case i < len(linesA) && (j == len(linesB) || lcs[i+1][j] >= lcs[i][j+1]):
+			sb.WriteString(Red + "-" + strings.TrimSuffix(linesA[i], "\n") + Reset + "\n")
+			i++
+		default:
+			sb.WriteString(Green + "+" + strings.TrimSuffix(linesB[j], "\n") + Reset + "\n")
+			j++
+		}
+	}
+	return sb.String()
+}
+
+type timerReport struct {
+	UnitDir   string   `json:"unit_dir"`
+	DryRun    bool     `json:"dry_run"`
+	Activated bool     `json:"activated"`
+	Created   []string `json:"created"`
+	Changed   []string `json:"changed"`
+	Unchanged []string `json:"unchanged"`
+	Removed   []string `json:"removed"`
+	ExitCode  int      `json:"exit_code"`
+}
+
+func generateTimers(config Config, opts timerOptions) (timerReport, error) {
+	report := timerReport{DryRun: opts.DryRun}
+	unitDir := opts.OutputDir
+	if unitDir == "" {
+		var err error
+		if opts.User {
+			unitDir, err = userUnitDir()
+		} else {
+			unitDir, err = systemdUnitDir()
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+	report.UnitDir = unitDir
+
+	units := renderUnits(config, opts)
+	plan, err := planTimers(config, unitDir, units)
+	if err != nil {
+		return report, err
+	}
+	names := func(units []unitFile) []string {
+		list := []string{}
+		for _, u := range units {
+			list = append(list, u.Name)
+		}
+		return list
+	}
+	report.Created, report.Changed, report.Unchanged = names(plan.Created), names(plan.Changed), names(plan.Unchanged)
+	report.Removed = append([]string{}, plan.Removed...)
+
+	if opts.DryRun {
+		printTimerPlan(unitDir, plan)
+		return report, nil
+	}
+
+	if err := os.MkdirAll(unitDir, 0755); err != nil {
+		return report, err
+	}
+
+	for _, name := range plan.Removed {
+		if !opts.NoActivate {
+			opts.systemctl("disable", "--now", name).Run()
+		}
+		os.Remove(filepath.Join(unitDir, name))
+	}
+
+	var timers []string
+	for _, u := range units {
+		if err := os.WriteFile(filepath.Join(unitDir, u.Name), []byte(u.Content), 0644); err != nil {
+			return report, err
+		}
+		if strings.HasSuffix(u.Name, ".timer") {
+			timers = append(timers, u.Name)
+		}
+	}
+
+	if opts.NoActivate {
+		fmt.Printf("Systemd timer files written to %s.\n", unitDir)
+		return report, nil
+	}
+
+	if err := opts.systemctl("daemon-reload").Run(); err != nil {
+		return report, fmt.Errorf("failed to reload systemd daemon: %v", err)
+	}
+	for _, t := range timers {
+		if err := opts.systemctl("enable", t).Run(); err != nil {
+			return report, fmt.Errorf("failed to enable %s: %v", t, err)
+		}
+		if err := opts.systemctl("restart", t).Run(); err != nil {
+			return report, fmt.Errorf("failed to restart %s: %v", t, err)
+		}
+	}
+
+	report.Activated = true
+	fmt.Printf("Systemd timer files written to %s and activated.\n", unitDir)
+	return report, nil
+}
@@ -0,0 +1,566 @@
+/*
+***********************************************
+
+	This file is part of Resticara.
+
+Resticara is free software: you can redistribute it and/or modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation, either version 3 of the License, or (at your option) any later version.
+
+Resticara is distributed in the hope that it will be useful, but WITHOUT ANY WARRANTY; without even the implied
+warranty of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+(c)2023 Vute Tech Ltd. <office@vute.tech>
+(c)2023 Blagovest Petrov <blagovest@petrovs.info>
+
+You should have received a copy of the GNU General Public License along with Foobar. If not, see <https://www.gnu.org/licenses/>.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// settingError is an invalid value of a config key.
+type settingError struct {
+	Section string
+	Key     string
+	Err     error
+}
+
+func (e settingError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("[%s]: %v", e.Section, e.Err)
+	}
+	return fmt.Sprintf("'%s' in %s: %v", e.Key, e.Section, e.Err)
+}
+
+// sectionKeys lists the keys known in the fixed sections.
+var sectionKeys = map[string][]string{
+	ini.DefaultSection: {"include"},
+	"general":          {"hostID", "instance", "retention_prune", "prune_schedule", "systemd_hardening", "notify_on_failure", "status_listen"},
+	"logging":          {"sink", "level", "file"},
+	"smtp":             {"enabled", "from", "username", "pass", "to", "server", "port"},
+	"matrix":           {"enabled", "server", "username", "pass", "room_id"},
+	"telegram":         {"enabled", "bot_token", "chat_id"},
+}
+
+var commonJobKeys = []string{
+	"bucket", "password", "tags", "host", "group_by", "copy_to",
+	"alert_min_added", "alert_max_added", "alert_change_percent", "alert_history", "alert_level", "retention_daily", "retention_weekly", "retention_monthly", "retention_prune",
+	"schedule", "prune_schedule", "randomized_delay", "accuracy",
+	"systemd_hardening", "nice", "io_scheduling_class", "cpu_quota", "memory_max",
+}
+
+// jobKeys returns the keys known in job sections of the given type, or of
+// any type when commandType is empty.
+func jobKeys(commandType string) []string {
+	keys := append([]string{}, commonJobKeys...)
+	for name, jobType := range jobTypes {
+		if commandType != "" && name != commandType {
+			continue
+		}
+		for _, key := range append(append([]string{}, jobType.required...), jobType.optional...) {
+			if indexOf(keys, key) < 0 {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+var logSinks = []string{"syslog", "journald", "stderr", "json"}
+
+// checkGeneralSettings validates the values in [general] and [logging].
+func checkGeneralSettings(cfg *ini.File) []settingError {
+	var errs []settingError
+	level := cfg.Section("logging").Key("level").MustString("info")
+	if _, ok := logLevels[strings.ToLower(level)]; !ok {
+		errs = append(errs, settingError{"logging", "level", fmt.Errorf("must be one of debug, info, warn or error")})
+	}
+	if sink := cfg.Section("logging").Key("sink").String(); sink != "" && indexOf(logSinks, sink) < 0 {
+		errs = append(errs, settingError{"logging", "sink", fmt.Errorf("must be one of %s", strings.Join(logSinks, ", "))})
+	}
+	for _, r := range cfg.Section("general").Key("instance").String() {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			errs = append(errs, settingError{"general", "instance", fmt.Errorf("may only contain letters, digits, '-' and '_'")})
+			break
+		}
+	}
+	if val := cfg.Section("general").Key("retention_prune").String(); val != "" {
+		if _, err := strconv.Atoi(val); err != nil {
+			errs = append(errs, settingError{"general", "retention_prune", fmt.Errorf("must be an integer")})
+		}
+	}
+	if val := cfg.Section("general").Key("prune_schedule").String(); val != "" {
+		if _, err := parseSchedule(val); err != nil {
+			errs = append(errs, settingError{"general", "prune_schedule", err})
+		}
+	}
+	for _, key := range []string{"systemd_hardening", "notify_on_failure"} {
+		if val := cfg.Section("general").Key(key).String(); val != "" {
+			if _, err := parseBool(val); err != nil {
+				errs = append(errs, settingError{"general", key, fmt.Errorf("must be a boolean")})
+			}
+		}
+	}
+	return errs
+}
+
+// checkJobSettings validates the values of one job section.
+func checkJobSettings(commandKey string, settings map[string]string) []settingError {
+	var errs []settingError
+	for _, key := range []string{"retention_daily", "retention_weekly", "retention_monthly"} {
+		if _, err := strconv.Atoi(settings[key]); err != nil {
+			errs = append(errs, settingError{commandKey, key, fmt.Errorf("must be an integer")})
+		}
+	}
+	if val, ok := settings["retention_prune"]; ok {
+		if _, err := strconv.Atoi(val); err != nil {
+			errs = append(errs, settingError{commandKey, "retention_prune", fmt.Errorf("must be an integer")})
+		}
+	}
+	for _, key := range []string{"schedule", "prune_schedule"} {
+		if val, ok := settings[key]; ok {
+			if _, err := parseSchedule(val); err != nil {
+				errs = append(errs, settingError{commandKey, key, err})
+			}
+		}
+	}
+	if val, ok := settings["systemd_hardening"]; ok {
+		if _, err := parseBool(val); err != nil {
+			errs = append(errs, settingError{commandKey, "systemd_hardening", fmt.Errorf("must be a boolean")})
+		}
+	}
+	if val, ok := settings["nice"]; ok {
+		if n, err := strconv.Atoi(val); err != nil || n < -20 || n > 19 {
+			errs = append(errs, settingError{commandKey, "nice", fmt.Errorf("must be an integer between -20 and 19")})
+		}
+	}
+	for _, tag := range listValue(settings["tags"]) {
+		if strings.ContainsAny(tag, " \t") {
+			errs = append(errs, settingError{commandKey, "tags", fmt.Errorf("tag %q contains whitespace", tag)})
+		}
+	}
+	if val, ok := settings["group_by"]; ok {
+		for _, field := range listValue(val) {
+			if field != "host" && field != "paths" && field != "tags" {
+				errs = append(errs, settingError{commandKey, "group_by", fmt.Errorf("must be a list of host, paths and tags")})
+				break
+			}
+		}
+	}
+	for _, key := range []string{"alert_min_added", "alert_max_added"} {
+		if val, ok := settings[key]; ok {
+			if _, err := parseByteSize(val); err != nil {
+				errs = append(errs, settingError{commandKey, key, err})
+			}
+		}
+	}
+	for _, key := range []string{"alert_change_percent", "alert_history"} {
+		if val, ok := settings[key]; ok {
+			if n, err := strconv.Atoi(val); err != nil || n < 1 {
+				errs = append(errs, settingError{commandKey, key, fmt.Errorf("must be a positive integer")})
+			}
+		}
+	}
+	if val, ok := settings["alert_level"]; ok && val != "warning" && val != "failed" {
+		errs = append(errs, settingError{commandKey, "alert_level", fmt.Errorf("must be warning or failed")})
+	}
+	for _, key := range []string{"randomized_delay", "accuracy"} {
+		if val, ok := settings[key]; ok {
+			if _, err := parseTimeSpan(val); err != nil {
+				errs = append(errs, settingError{commandKey, key, err})
+			}
+		}
+	}
+	return errs
+}
+
+type configIssue struct {
+	Severity string `json:"severity"`
+	File     string `json:"file,omitempty"`
+	Section  string `json:"section,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+}
+
+func (i configIssue) String() string {
+	var where string
+	if i.Section != "" {
+		where = "[" + i.Section + "] "
+	}
+	if i.Key != "" {
+		where += i.Key + ": "
+	}
+	return fmt.Sprintf("%s: %s%s", i.Severity, where, i.Message)
+}
+
+var matrixRoomRe = regexp.MustCompile(`^[!#][^:]+:.+$`)
+
+type configValidation struct {
+	Issues   []configIssue
+	Source   *configSource
+	Settings map[string]map[string]string
+	Origins  map[string]map[string]string
+}
+
+// validateConfig checks the config file and reports every problem found,
+// where readConfig stops at the first one. It also returns the effective
+// settings of every job.
+func validateConfig(path string) configValidation {
+	cfg, src, err := loadConfig(path)
+	if err != nil {
+		// the loader errors carry their location already
+		return configValidation{Issues: []configIssue{{Severity: "error", Message: err.Error()}}, Source: src}
+	}
+
+	var issues []configIssue
+	report := func(severity, section, key, format string, args ...any) {
+		loc := src.locate(section, key)
+		issues = append(issues, configIssue{Severity: severity, File: loc.File, Section: section, Key: key, Line: loc.Line, Message: fmt.Sprintf(format, args...)})
+	}
+	unknownKeys := func(section *ini.Section, known []string) {
+		for _, key := range section.KeyStrings() {
+			if indexOf(known, key) >= 0 {
+				continue
+			}
+			if s := suggest(key, known); s != "" {
+				report("warning", section.Name(), key, "unknown key, did you mean '%s'?", s)
+			} else {
+				report("warning", section.Name(), key, "unknown key")
+			}
+		}
+	}
+
+	for _, e := range interpolateConfig(cfg) {
+		report("error", e.Section, e.Key, "%v", e.Err)
+	}
+	for _, e := range checkGeneralSettings(cfg) {
+		report("error", e.Section, e.Key, "%v", e.Err)
+	}
+	merged, origins, errs := mergeJobSettings(cfg)
+	for _, e := range errs {
+		report("error", e.Section, e.Key, "%v", e.Err)
+	}
+
+	var fixedSections, types []string
+	for name := range sectionKeys {
+		fixedSections = append(fixedSections, name)
+	}
+	for name := range jobTypes {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+
+	hardening := cfg.Section("general").Key("systemd_hardening").MustBool(false)
+	jobs := 0
+	for _, section := range cfg.Sections() {
+		name := section.Name()
+		if known, ok := sectionKeys[name]; ok {
+			unknownKeys(section, known)
+			continue
+		}
+		if name == "defaults" {
+			unknownKeys(section, jobKeys(""))
+			continue
+		}
+		if strings.HasPrefix(name, templatePrefix) {
+			unknownKeys(section, append(jobKeys(""), "inherits"))
+			continue
+		}
+		if repoName, ok := strings.CutPrefix(name, repositoryPrefix); ok {
+			unknownKeys(section, repositoryKeys)
+			_, repoErrs := newRepository(repoName, section.KeysHash())
+			for _, e := range repoErrs {
+				if e.Err == errMissing {
+					report("error", name, "", "missing required key '%s'", e.Key)
+				} else {
+					report("error", name, e.Key, "%v", e.Err)
+				}
+			}
+			continue
+		}
+		commandType, _, isJob := strings.Cut(name, ":")
+		if !isJob {
+			if s := suggest(name, fixedSections); s != "" {
+				report("warning", name, "", "unknown section, did you mean [%s]?", s)
+			} else {
+				report("warning", name, "", "unknown section, ignored")
+			}
+			continue
+		}
+		if _, ok := jobTypes[commandType]; !ok {
+			if s := suggest(commandType, types); s != "" {
+				report("error", name, "", "unknown job type '%s', did you mean '%s'?", commandType, s)
+			} else {
+				report("error", name, "", "unknown job type '%s', expected one of %s", commandType, strings.Join(types, ", "))
+			}
+			continue
+		}
+		jobs++
+
+		settings, ok := merged[name]
+		if !ok {
+			// the inheritance could not be resolved
+			continue
+		}
+		job, jobErrs := newJob(name, settings)
+		for _, e := range jobErrs {
+			if e.Err == errMissing {
+				report("error", name, "", "missing required key '%s'", e.Key)
+			} else if settings[e.Key] == "" {
+				report("error", name, "", "'%s': %v", e.Key, e.Err)
+			} else {
+				report("error", origins[name][e.Key], e.Key, "%v", e.Err)
+			}
+		}
+		for _, repoName := range listValue(settings["copy_to"]) {
+			if _, err := cfg.GetSection(repositoryPrefix + repoName); err != nil {
+				report("error", origins[name]["copy_to"], "copy_to", "unknown repository '%s'", repoName)
+			}
+		}
+		if dir, ok := job.(*DirJob); ok && dir.Snapshot != "" && jobHardening(Config{Hardening: hardening}, job.Settings()) {
+			report("error", origins[name]["snapshot"], "snapshot", "cannot be combined with 'systemd_hardening', which forbids mounting")
+		}
+		known := jobKeys(commandType)
+		unknownKeys(section, append(known, "inherits"))
+		for key, origin := range origins[name] {
+			if origin != name && indexOf(known, key) < 0 && indexOf(jobKeys(""), key) >= 0 {
+				report("warning", origin, key, "not used by %s jobs such as [%s]", commandType, name)
+			}
+		}
+	}
+	if jobs == 0 {
+		report("warning", "", "", "no backup jobs configured")
+	}
+
+	smtp := cfg.Section("smtp")
+	if smtp.Key("enabled").MustBool(true) {
+		for _, key := range []string{"from", "to", "server", "port"} {
+			if smtp.Key(key).String() == "" {
+				report("error", "smtp", "", "Email notifications are enabled but '%s' is not set", key)
+			}
+		}
+		if port := smtp.Key("port").String(); port != "" {
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				report("error", "smtp", "port", "must be a port number")
+			}
+		}
+	}
+
+	matrix := cfg.Section("matrix")
+	if matrix.Key("enabled").MustBool(false) {
+		for _, key := range []string{"server", "username", "pass", "room_id"} {
+			if matrix.Key(key).String() == "" {
+				report("error", "matrix", "", "Matrix notifications are enabled but '%s' is not set", key)
+			}
+		}
+		if room := matrix.Key("room_id").String(); room != "" && !matrixRoomRe.MatchString(room) {
+			report("error", "matrix", "room_id", "must be a room ID like !abcdefg:example.com or an alias like #backups:example.com")
+		}
+	}
+
+	telegram := cfg.Section("telegram")
+	if telegram.Key("enabled").MustBool(false) {
+		if telegram.Key("bot_token").String() == "" {
+			report("error", "telegram", "", "Telegram notifications are enabled but 'bot_token' is not set")
+		}
+		if id, err := strconv.ParseInt(telegram.Key("chat_id").String(), 10, 64); err != nil || id == 0 {
+			report("error", "telegram", "chat_id", "must be a non-zero integer")
+		}
+	}
+
+	// report the issues in the order of the files and lines
+	fileOrder := make(map[string]int)
+	for i, file := range src.files {
+		fileOrder[file] = i
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		if issues[i].File != issues[j].File {
+			return fileOrder[issues[i].File] < fileOrder[issues[j].File]
+		}
+		return issues[i].Line < issues[j].Line
+	})
+	return configValidation{Issues: issues, Source: src, Settings: merged, Origins: origins}
+}
+
+func indexOf(list []string, value string) int {
+	for i, v := range list {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// suggest returns the candidate closest to word, or "" when none is close
+// enough to be a likely typo.
+func suggest(word string, candidates []string) string {
+	best, bestDistance := "", len(word)/3+2
+	for _, c := range candidates {
+		d := levenshtein(strings.ToLower(word), strings.ToLower(c))
+		if d < bestDistance || d == bestDistance && c < best {
+			best, bestDistance = c, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+type jobSummary struct {
+	Source   string            `json:"source"`
+	Settings map[string]string `json:"settings"`
+	Origins  map[string]string `json:"origins"`
+}
+
+// configCommand implements "resticara config <subcommand>".
+func configCommand(configPath string, args []string) int {
+	if len(args) > 0 && args[0] == "convert" {
+		return convertCommand(configPath, args[1:])
+	}
+	if len(args) == 0 || args[0] != "validate" {
+		return fail(exitConfigError, "Usage: resticara config validate [--strict] | convert --to=yaml|toml|ini [--output=FILE]")
+	}
+	validateFlags := flag.NewFlagSet("config validate", flag.ExitOnError)
+	strict := validateFlags.Bool("strict", false, "Treat warnings as errors")
+	validateFlags.Parse(args[1:])
+
+	validation := validateConfig(configPath)
+	src := validation.Source
+	report := struct {
+		Path     string                `json:"path"`
+		Valid    bool                  `json:"valid"`
+		Errors   int                   `json:"errors"`
+		Warnings int                   `json:"warnings"`
+		Issues   []configIssue         `json:"issues"`
+		Files    []string              `json:"files"`
+		Jobs     map[string]jobSummary `json:"jobs"`
+		ExitCode int                   `json:"exit_code"`
+	}{Path: configPath, Issues: validation.Issues, Files: src.files, Jobs: make(map[string]jobSummary)}
+
+	for _, issue := range report.Issues {
+		color := Yellow
+		if issue.Severity == "error" {
+			report.Errors++
+			color = Red
+		} else {
+			report.Warnings++
+		}
+		if issue.File == "" {
+			fmt.Printf("%s%s%s\n", color, issue, Reset)
+		} else {
+			fmt.Printf("%s: %s%s%s\n", configLocation{issue.File, issue.Line}, color, issue, Reset)
+		}
+	}
+
+	var jobs []string
+	for name, settings := range validation.Settings {
+		commandType, _, _ := strings.Cut(name, ":")
+		if _, known := jobTypes[commandType]; !known {
+			continue
+		}
+		jobs = append(jobs, name)
+		summary := jobSummary{Source: src.locate(name, "").String(), Settings: make(map[string]string), Origins: validation.Origins[name]}
+		for key, value := range settings {
+			if key == "password" {
+				value = "********"
+			}
+			summary.Settings[key] = displayValue(value)
+		}
+		report.Jobs[name] = summary
+	}
+	sort.Strings(jobs)
+	if len(src.files) > 1 {
+		fmt.Printf("Read %s\n", strings.Join(src.files, ", "))
+	}
+	for _, name := range jobs {
+		summary := report.Jobs[name]
+		fmt.Printf(Bold+"[%s]"+Reset+" ; %s\n", name, summary.Source)
+		var keys []string
+		for key := range summary.Settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if origin := summary.Origins[key]; origin != name {
+				fmt.Printf("%s = %s ; from [%s]\n", key, summary.Settings[key], origin)
+			} else {
+				fmt.Printf("%s = %s\n", key, summary.Settings[key])
+			}
+		}
+		fmt.Println()
+	}
+
+	report.Valid = report.Errors == 0 && (!*strict || report.Warnings == 0)
+	if report.Valid {
+		fmt.Printf(Green+"%s is valid"+Reset+" (%d warnings)\n", configPath, report.Warnings)
+	} else {
+		fmt.Printf(Red+"%s is invalid"+Reset+" (%d errors, %d warnings)\n", configPath, report.Errors, report.Warnings)
+		report.ExitCode = exitConfigError
+	}
+	if report.Issues == nil {
+		report.Issues = []configIssue{}
+	}
+	writeReport(report)
+	return report.ExitCode
+}
+
+func convertCommand(configPath string, args []string) int {
+	convertFlags := flag.NewFlagSet("config convert", flag.ExitOnError)
+	to := convertFlags.String("to", "yaml", "Target format, yaml, toml or ini")
+	output := convertFlags.String("output", "", "Write the converted config to this file instead of stdout")
+	convertFlags.Parse(args)
+
+	content, err := convertConfig(configPath, *to)
+	if err != nil {
+		return fail(exitConfigError, "Error converting %s: %v", configPath, err)
+	}
+	report := struct {
+		Path     string `json:"path"`
+		Format   string `json:"format"`
+		Output   string `json:"output,omitempty"`
+		Content  string `json:"content"`
+		ExitCode int    `json:"exit_code"`
+	}{Path: configPath, Format: *to, Output: *output, Content: string(content)}
+
+	if *output == "" {
+		if !jsonOutput {
+			os.Stdout.Write(content)
+		}
+	} else {
+		if err := os.WriteFile(*output, content, 0600); err != nil {
+			return fail(exitFailure, "Error writing %s: %v", *output, err)
+		}
+		fmt.Printf("Converted %s to %s.\n", configPath, *output)
+	}
+	writeReport(report)
+	return exitOK
+}